@@ -0,0 +1,3 @@
+// +build !linux !cgo
+
+package btrfs
@@ -0,0 +1,7 @@
+// +build !linux
+
+package overlay
+
+func SupportsNativeOverlay(graphroot, rundir string) (bool, error) {
+	return false, nil
+}
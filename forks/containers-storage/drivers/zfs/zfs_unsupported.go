@@ -0,0 +1,11 @@
+// +build !linux,!freebsd
+
+package zfs
+
+func checkRootdirFs(rootdir string) error {
+	return nil
+}
+
+func getMountpoint(id string) string {
+	return id
+}
@@ -0,0 +1,5600 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/stringid"
+	"github.com/containers/storage/pkg/stringutils"
+	"github.com/containers/storage/pkg/system"
+	"github.com/containers/storage/pkg/truncindex"
+	"github.com/hashicorp/go-multierror"
+	jsoniter "github.com/json-iterator/go"
+	digest "github.com/opencontainers/go-digest"
+	imagespecs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	selinux "github.com/opencontainers/selinux/go-selinux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ImageDigestManifestBigDataNamePrefix is a prefix of big data item
+	// names which we consider to be manifests, used for computing a
+	// "digest" value for the image as a whole, by which we can locate the
+	// image later.
+	ImageDigestManifestBigDataNamePrefix = "manifest"
+	// ImageDigestBigDataKey is provided for compatibility with older
+	// versions of the image library.  It will be removed in the future.
+	ImageDigestBigDataKey = "manifest"
+)
+
+// An Image is a reference to a layer and an associated metadata string.
+type Image struct {
+	// ID is either one which was specified at create-time, or a random
+	// value which was generated by the library.
+	ID string `json:"id"`
+
+	// Digest is a digest value that we can use to locate the image, if one
+	// was specified at creation-time.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Digests is a list of digest values of the image's manifests, and
+	// possibly a manually-specified value, that we can use to locate the
+	// image.  If Digest is set, its value is also in this list.
+	Digests []digest.Digest `json:"-"`
+
+	// Names is an optional set of user-defined convenience values.  The
+	// image can be referred to by its ID or any of its names.  Names are
+	// unique among images, and are often the text representation of tagged
+	// or canonical references.
+	Names []string `json:"names,omitempty"`
+
+	// NamesHistory is an optional set of Names the image had in the past. The
+	// contained names are free from any duplicates, whereas the newest entry
+	// is the first one.
+	NamesHistory []string `json:"names-history,omitempty"`
+
+	// TopLayer is the ID of the topmost layer of the image itself, if the
+	// image contains one or more layers.  Multiple images can refer to the
+	// same top layer.
+	TopLayer string `json:"layer,omitempty"`
+
+	// MappedTopLayers are the IDs of alternate versions of the top layer
+	// which have the same contents and parent, and which differ from
+	// TopLayer only in which ID mappings they use.  When the image is
+	// to be removed, they should be removed before the TopLayer, as the
+	// graph driver may depend on that.
+	MappedTopLayers []string `json:"mapped-layers,omitempty"`
+
+	// Metadata is data we keep for the convenience of the caller.  It is not
+	// expected to be large, since it is kept in memory.
+	Metadata string `json:"metadata,omitempty"`
+
+	// BigDataNames is a list of names of data items that we keep for the
+	// convenience of the caller.  They can be large, and are only in
+	// memory when being read from or written to disk.
+	BigDataNames []string `json:"big-data-names,omitempty"`
+
+	// BigDataSizes maps the names in BigDataNames to the sizes of the data
+	// that has been stored, if they're known.
+	BigDataSizes map[string]int64 `json:"big-data-sizes,omitempty"`
+
+	// BigDataDigests maps the names in BigDataNames to the digests of the
+	// data that has been stored, if they're known.
+	BigDataDigests map[string]digest.Digest `json:"big-data-digests,omitempty"`
+
+	// Created is the datestamp for when this image was created.  Older
+	// versions of the library did not track this information, so callers
+	// will likely want to use the IsZero() method to verify that a value
+	// is set before using it.
+	Created time.Time `json:"created,omitempty"`
+
+	// ReadOnly is true if this image resides in a read-only layer store.
+	ReadOnly bool `json:"-"`
+
+	Flags map[string]interface{} `json:"flags,omitempty"`
+
+	// RetentionClass is an optional, caller-defined label (e.g. "daily",
+	// "weekly") used by external lifecycle/pruning policies to decide how
+	// long to keep an image.  The store only persists and indexes it; it
+	// does not interpret or enforce any retention policy itself.
+	RetentionClass string `json:"retention-class,omitempty"`
+
+	// BigDataEncryption maps the names in BigDataNames to the encryption
+	// metadata for items that are stored encrypted at rest.  The store
+	// never encrypts or decrypts data itself; it only persists which key
+	// and algorithm a caller used, while BigDataDigests continues to
+	// record the *plaintext* digest so that the item's identity doesn't
+	// change depending on how it happens to be encrypted.
+	BigDataEncryption map[string]BigDataEncryptionInfo `json:"big-data-encryption,omitempty"`
+
+	// Pulled is the datestamp for when the caller retrieved this image,
+	// as distinct from Created, which reflects the image's build time
+	// from its config and may predate when any particular host actually
+	// pulled it.  Age-based pruning policies can choose whichever of the
+	// two timestamps matches their intent.
+	Pulled time.Time `json:"pulled,omitempty"`
+
+	// Comment is a free-text, human-authored note about the image,
+	// distinct from Metadata, which callers treat as a structured value.
+	// It defaults to empty for records written before this field existed.
+	Comment string `json:"comment,omitempty"`
+
+	// Hidden marks an image (e.g. an infra image like a pause container)
+	// to be excluded from Images() by default.  It's a first-class flag
+	// rather than a naming convention, so that listing code doesn't need
+	// to special-case names.  See ImagesFiltered.
+	Hidden bool `json:"hidden,omitempty"`
+
+	// RootFSSize caches the uncompressed size in bytes of the image's
+	// layers, to avoid recomputing it from the layer store on every
+	// size-reporting call.  It's nil when unknown; size-reporting callers
+	// should prefer this value and fall back to computation only then. A
+	// pointer, rather than a plain int64 with a -1 sentinel, so that a
+	// deliberately recorded zero-byte rootfs (e.g. a scratch-based image)
+	// round-trips through Save/Load instead of being indistinguishable
+	// from "unknown" and coerced back to it.
+	RootFSSize *int64 `json:"rootfs-size,omitempty"`
+
+	// BigDataFileNames maps a subset of the names in BigDataNames to the
+	// actual file name under which that item is stored on disk, for
+	// items whose name was unsuitable for use directly as a file name
+	// (e.g. because it was hashed; see SetBigDataNameHashing) or is long
+	// enough that the usual escaping in makeBigDataBaseName would still
+	// risk exceeding filesystem limits.  A name with no entry here uses
+	// makeBigDataBaseName(name) as before.
+	BigDataFileNames map[string]string `json:"big-data-file-names,omitempty"`
+
+	// RecordDigest is the digest of this image's own canonical JSON form
+	// (with RecordDigest itself excluded), recomputed and verified on
+	// every Load so that corruption or tampering limited to a single
+	// record is caught without failing to load the rest of the store.
+	// It's empty on records written before this field existed, which
+	// Load treats as unverified rather than tampered.
+	RecordDigest digest.Digest `json:"record-digest,omitempty"`
+
+	// ExpiresAt, if non-zero, is when this image becomes eligible for
+	// PruneExpired to delete it, for ephemeral/scratch images that want
+	// a built-in cleanup trigger instead of external cron logic.  See
+	// SetExpiry.
+	ExpiresAt time.Time `json:"expires-at,omitempty"`
+
+	// DiffIDs caches the ordered list of layer diff IDs that make up the
+	// image's layer stack, so that two images' layer stacks can be
+	// compared for shared content without consulting the layer store. It's
+	// optional, populated by callers at create/commit time via
+	// SetDiffIDs, and empty on older records.  See ByDiffID.
+	DiffIDs []digest.Digest `json:"diff-ids,omitempty"`
+
+	// LastScanned is when a security scanner last examined this image,
+	// set via SetScanStatus.  The store just persists it; it doesn't run
+	// or schedule scans itself.  See ImagesNeedingScan.
+	LastScanned time.Time `json:"last-scanned,omitempty"`
+
+	// ScanStatus is the caller-defined result of the last scan (e.g.
+	// "pass", "fail", "error"), set together with LastScanned via
+	// SetScanStatus.  The store never interprets its value.
+	ScanStatus string `json:"scan-status,omitempty"`
+
+	// Labels holds caller-defined structured provenance (e.g. build
+	// host, pipeline ID) as plain key/value strings, set via SetLabel
+	// and cleared via RemoveLabel.  Unlike Metadata, which is a single
+	// opaque value, and Flags, which is reserved for the library's own
+	// bookkeeping, Labels is meant for user-attached tags.  It's nil on
+	// records written before this field existed.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// BigDataEncryptionInfo records how an encrypted big data item was
+// protected, so that a caller with access to the matching key can decrypt
+// it again.  The store treats these values as opaque.
+type BigDataEncryptionInfo struct {
+	// KeyID identifies, in a caller-defined namespace, the key that was
+	// used to encrypt the item.
+	KeyID string `json:"key-id"`
+	// Algorithm identifies, in a caller-defined namespace, the algorithm
+	// that was used to encrypt the item.
+	Algorithm string `json:"algorithm"`
+}
+
+// ReservedFlagKeys lists Flags keys that callers may not set via SetFlag,
+// SetFlags, or ClearFlags, because they're reserved for internal or
+// future use by this package.
+var ReservedFlagKeys = map[string]struct{}{}
+
+// DuplicateNamePolicy controls how Load reacts when two images in
+// images.json claim the same name.  See ImageStore.SetDuplicateNamePolicy.
+type DuplicateNamePolicy int
+
+const (
+	// DuplicateNamePolicyResolve is the long-standing default: the
+	// earlier image silently loses the conflicting name, and Load saves
+	// the result if the store is read-write.
+	DuplicateNamePolicyResolve DuplicateNamePolicy = iota
+	// DuplicateNamePolicyError makes Load fail with ErrDuplicateImageNames
+	// as soon as it finds a conflicting name, leaving images.json and the
+	// in-memory indexes untouched.
+	DuplicateNamePolicyError
+	// DuplicateNamePolicyReport makes Load leave conflicting names as
+	// they are, without saving, and record them for retrieval via
+	// DuplicateNameConflicts so the caller can decide what to do.
+	DuplicateNamePolicyReport
+)
+
+// DuplicateNameConflict describes one name that more than one image in
+// images.json claimed as of the most recent Load, when
+// DuplicateNamePolicyReport is in effect.  See
+// ImageStore.DuplicateNameConflicts.
+type DuplicateNameConflict struct {
+	// Name is the conflicting name.
+	Name string
+	// ImageIDs lists the IDs of the images that claimed Name, in the
+	// order they were encountered in images.json.
+	ImageIDs []string
+}
+
+// NameConflict describes one name that the most recent Load found claimed
+// by more than one image under DuplicateNamePolicyResolve, the default
+// policy that silently reassigns the name instead of erroring or reporting
+// it as a DuplicateNameConflict.  See ImageStore.LoadConflicts.
+type NameConflict struct {
+	// Name is the conflicting name.
+	Name string
+	// KeptImageID is the ID of the image that Name resolved to.
+	KeptImageID string
+	// StrippedImageID is the ID of the image that lost Name.
+	StrippedImageID string
+}
+
+// DigestConflict describes two images that are indexed under the same
+// digest, by ByDigest and similar lookups, whose on-disk manifest big data
+// items recorded under that digest don't actually agree byte-for-byte. See
+// ROImageStore.FindDigestManifestConflicts.
+type DigestConflict struct {
+	// Digest is the shared digest value under which both images are
+	// indexed.
+	Digest digest.Digest
+	// ImageA and KeyA identify the first image and the name of the
+	// manifest big data item on it whose content was compared.
+	ImageA, KeyA string
+	// ImageB and KeyB identify the second image and the name of the
+	// manifest big data item on it whose content was compared.
+	ImageB, KeyB string
+}
+
+// ReconcilePolicy controls which of the store's existing images
+// ImageStore.ReconcileTo is allowed to delete when reconciling it against a
+// desired list.
+type ReconcilePolicy struct {
+	// DeleteExtras, if true, deletes every image present in the store but
+	// absent from the desired list, except those protected by the
+	// "pinned" flag, ReadOnly, or InUse.  If false, extras are left
+	// alone and reported as ReconcileSkipped.
+	DeleteExtras bool
+
+	// InUse reports whether an image ID absent from the desired list is
+	// still in use by something outside the image store's view, such as
+	// a container, the same role it plays for RemovableImages.  Images
+	// it reports true for are never deleted.  It may be nil, in which
+	// case only pinning and ReadOnly protect an image.
+	InUse func(imageID string) bool
+}
+
+// ReconcileAction describes what ImageStore.ReconcileTo did, or attempted,
+// for a single image.
+type ReconcileAction string
+
+const (
+	// ReconcileCreated means the image was absent and has been created.
+	ReconcileCreated ReconcileAction = "created"
+	// ReconcileUpdated means the image's names or metadata didn't match
+	// the desired values and have been changed to match.
+	ReconcileUpdated ReconcileAction = "updated"
+	// ReconcileUnchanged means the image already matched the desired
+	// values.
+	ReconcileUnchanged ReconcileAction = "unchanged"
+	// ReconcileDeleted means the image was absent from the desired list
+	// and has been deleted.
+	ReconcileDeleted ReconcileAction = "deleted"
+	// ReconcileSkipped means the image was left alone, either because
+	// policy protects it or because the operation needed to reconcile it
+	// failed; Err distinguishes the two.
+	ReconcileSkipped ReconcileAction = "skipped"
+)
+
+// ReconcileResult records the outcome of reconciling a single image.
+type ReconcileResult struct {
+	// ID identifies the image the result is about.
+	ID string
+	// Action is what ReconcileTo did, or attempted, for this image.
+	Action ReconcileAction
+	// Err is set if Action is ReconcileSkipped because the operation
+	// needed to bring this image in line with the desired state failed,
+	// as opposed to being skipped by policy.
+	Err error
+}
+
+// ReconcileReport summarizes every action ImageStore.ReconcileTo took,
+// in the order taken.
+type ReconcileReport struct {
+	Results []ReconcileResult
+}
+
+// ImageEventType describes what kind of change an ImageEvent reports.
+type ImageEventType string
+
+const (
+	// ImageEventCreated means a new image record was committed.
+	ImageEventCreated ImageEventType = "created"
+	// ImageEventUpdated means an existing image's record was mutated
+	// and committed.
+	ImageEventUpdated ImageEventType = "updated"
+	// ImageEventRemoved means an image record was deleted.
+	ImageEventRemoved ImageEventType = "removed"
+)
+
+// ImageEvent reports one committed mutation to an image, for EventSink.
+type ImageEvent struct {
+	// Type is the kind of change that was committed.
+	Type ImageEventType
+	// ID is the image the change was committed for.
+	ID string
+}
+
+// EventSink receives ImageEvents after each committed mutation, for
+// integrators that want to forward them to something like the systemd
+// journal, a message bus, or an audit daemon, beyond what in-process
+// callers can observe directly.  See ImageStore.AddEventSink.
+type EventSink interface {
+	// Publish is called with each committed ImageEvent, in commit
+	// order.  It must not block for long: a sink that's slow enough to
+	// fill its buffer starts losing events (see
+	// ImageStore.DroppedEvents) rather than stalling Save.
+	Publish(event ImageEvent)
+}
+
+// eventSinkBufferSize bounds how many undelivered events an EventSink
+// worker queues before newer events are dropped rather than blocking
+// Save.  See eventSinkWorker.
+const eventSinkBufferSize = 256
+
+// eventSinkWorker delivers ImageEvents to one EventSink from a dedicated
+// goroutine, so that a slow or blocked sink can't stall Save.  Delivery
+// past the buffer is best-effort: once it's full, further events are
+// dropped and counted in dropped instead of blocking the publisher.  The
+// goroutine runs until close is called; every worker must eventually be
+// closed (see RemoveEventSink, imageStore.stopEventSinks) or it leaks for
+// the life of the process.
+type eventSinkWorker struct {
+	sink    EventSink
+	events  chan ImageEvent
+	dropped uint64
+	done    chan struct{}
+}
+
+func newEventSinkWorker(sink EventSink) *eventSinkWorker {
+	w := &eventSinkWorker{
+		sink:   sink,
+		events: make(chan ImageEvent, eventSinkBufferSize),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		for event := range w.events {
+			w.sink.Publish(event)
+		}
+	}()
+	return w
+}
+
+func (w *eventSinkWorker) publish(event ImageEvent) {
+	select {
+	case w.events <- event:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// close stops the worker's delivery goroutine, dropping any events still
+// queued, and waits for the goroutine to exit.  It must only be called
+// once per worker.
+func (w *eventSinkWorker) close() {
+	close(w.events)
+	<-w.done
+}
+
+// CreateOptions collects everything CreateComplete needs to bring a fully
+// formed image into existence in one Save, so that no other process ever
+// observes it lacking its big data or names.
+type CreateOptions struct {
+	// ID is either one which was specified at create-time, or empty to
+	// have one generated at random, as with Create.
+	ID string
+	// Names is the initial set of names to associate with the image.
+	Names []string
+	// Layer is the ID of the image's topmost layer, as with Create.
+	Layer string
+	// Metadata is the initial value of the image's Metadata field.
+	Metadata string
+	// Created is the image's creation timestamp.  The zero value means
+	// "now", as with Create.
+	Created time.Time
+	// SearchableDigest is an optional digest by which the image can be
+	// located, as with Create.
+	SearchableDigest digest.Digest
+	// BigData holds every big data item, including the manifest, to
+	// write for the image.  Keys for which IsManifestKey (as set by
+	// SetIsManifestKey) returns true are digested with DigestManifest;
+	// all others are digested with the canonical digest algorithm.
+	BigData map[string][]byte
+	// DigestManifest computes the digest of a manifest big data item. It
+	// must be set if BigData contains a manifest key.
+	DigestManifest func([]byte) (digest.Digest, error)
+}
+
+// ImageQuery combines several filter criteria, all of which must match
+// (AND semantics), for use with ROImageStore.Query.  The zero value of each
+// field means "don't filter on this criterion".
+type ImageQuery struct {
+	// NamePrefix, if not empty, matches images with at least one Name
+	// starting with this string.
+	NamePrefix string
+	// Digest, if not empty, matches images for which ByDigest would
+	// return a result.
+	Digest digest.Digest
+	// CreatedAfter, if not zero, matches images with a Created timestamp
+	// at or after this time.
+	CreatedAfter time.Time
+	// CreatedBefore, if not zero, matches images with a Created
+	// timestamp at or before this time.
+	CreatedBefore time.Time
+	// Flags, if not empty, matches images whose Flags contains every
+	// key in this map set to the corresponding value.
+	Flags map[string]interface{}
+}
+
+// ReadOnlyError is returned in place of a bare ErrStoreIsReadOnly by a
+// handful of ImageStore write methods (see their docs), identifying which
+// operation was refused and the path of the store that refused it, so a
+// caller that wants to react programmatically (for example, by falling
+// through to a read-write layer store) doesn't have to parse an error
+// string to do it.  It wraps ErrStoreIsReadOnly, so existing
+// errors.Is(err, ErrStoreIsReadOnly) checks keep working.
+type ReadOnlyError struct {
+	Op   string
+	Path string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("not allowed to %s at %q", e.Op, e.Path)
+}
+
+func (e *ReadOnlyError) Unwrap() error {
+	return ErrStoreIsReadOnly
+}
+
+// ROImageStore provides bookkeeping for information about Images.
+type ROImageStore interface {
+	ROFileBasedStore
+	ROMetadataStore
+	ROBigDataStore
+
+	// LoadTolerant is a recovery path for a damaged images.json: it
+	// decodes the array element-by-element, skipping and reporting any
+	// entry that fails to parse instead of giving up on the whole file
+	// the way Load does.  It indexes everything that did parse but never
+	// Saves on its own; recovering a damaged store back to disk is left
+	// to the caller.
+	LoadTolerant() ([]InvalidImageRecord, error)
+
+	// LastLoadError returns the error, if any, returned by the most
+	// recent Load, including ones triggered internally by
+	// ReloadIfChanged.  It lets a caller who isn't driving Load or
+	// ReloadIfChanged directly (e.g. because a background goroutine
+	// calls ReloadIfChanged on its behalf) notice a load failure it
+	// otherwise wouldn't see.
+	LastLoadError() error
+
+	// Exists checks if there is an image with the given ID or name.
+	Exists(id string) bool
+
+	// Get retrieves information about an image given an ID or name.
+	Get(id string) (*Image, error)
+
+	// GetRef is like Get, but returns the internal image record and a
+	// release function instead of a copy.  See the method's documentation
+	// for the contract callers must uphold.
+	GetRef(id string) (*Image, func(), error)
+
+	// Lookup attempts to translate a name to an ID.  Most methods do this
+	// implicitly.
+	Lookup(name string) (string, error)
+
+	// Images returns a slice enumerating the known images, excluding
+	// those marked Hidden.
+	Images() ([]Image, error)
+
+	// ImagesFiltered is like Images, but also returns images marked
+	// Hidden if opts.IncludeHidden is set.
+	ImagesFiltered(opts ImagesFilterOptions) ([]Image, error)
+
+	// ByDigest returns a slice enumerating the images which have either an
+	// explicitly-set digest, or a big data item with a name that starts
+	// with ImageDigestManifestBigDataNamePrefix, which matches the
+	// specified digest.
+	ByDigest(d digest.Digest) ([]*Image, error)
+
+	// ByName returns copies of all images whose Names slice contains the
+	// exact string name.  A name can only belong to one image at a time,
+	// so in practice this returns at most one match, but it's exposed as
+	// a slice for symmetry with ByDigest and to make that invariant
+	// something a caller can check rather than assume.
+	ByName(name string) ([]*Image, error)
+
+	// ByDiffID returns the images whose cached DiffIDs includes d, for
+	// finding images that share a layer by content using only image
+	// metadata, without consulting the layer store.  It only finds
+	// images for which SetDiffIDs was called.
+	ByDiffID(d digest.Digest) ([]*Image, error)
+
+	// FindInvalidNames reports, per image ID, the names on that image
+	// for which valid returns false, as a migration aid for operators
+	// preparing to enable strict name validation on write: it surfaces
+	// what's already in the store that would fail before the check is
+	// turned on.  Images with no invalid names are omitted.
+	FindInvalidNames(valid func(name string) bool) (map[string][]string, error)
+
+	// BigDataReader returns an open file for a big data item and its
+	// known size from BigDataSizes (or -1 if unknown), for streaming a
+	// large item instead of loading it whole via BigData.  It's backed
+	// by a per-image lock distinct from the store-wide lock, so it
+	// doesn't block behind (or block) a BigData/SetBigData call for a
+	// different image; callers must close it promptly, since it's held
+	// for as long as the ReadCloser stays open.
+	BigDataReader(id, key string) (io.ReadCloser, int64, error)
+
+	// DataDirUsage walks id's datadir and sums the actual on-disk size of
+	// every file under it, including subdirectories, for the true
+	// on-disk footprint of an image's big data as opposed to the
+	// logical sizes recorded in BigDataSizes.
+	DataDirUsage(id string) (int64, error)
+
+	// ImagesByRegistry returns the images with at least one name whose
+	// hostname portion, as extracted by SetRegistryHostParser (or the
+	// default parser if none was installed), equals host.  It supports
+	// bulk retagging or cleanup when a registry is decommissioned.
+	ImagesByRegistry(host string) ([]*Image, error)
+
+	// ImagesSortedBySize returns every known image ordered by the size
+	// sizeFn reports for it (descending if descending is true, ascending
+	// otherwise), breaking ties by ID for a deterministic order.  If
+	// skipErrors is true, images for which sizeFn errors are omitted
+	// from the result instead of failing the call.
+	ImagesSortedBySize(sizeFn func(*Image) (int64, error), descending, skipErrors bool) ([]Image, error)
+
+	// ImagesNeedingScan returns the images whose ScanStatus is unset, or
+	// whose LastScanned is more than staleAfter in the past, for
+	// scheduling tools that want to find unscanned or stale-scanned
+	// images.  A zero staleAfter matches any image that has ever been
+	// scanned.
+	ImagesNeedingScan(staleAfter time.Duration) ([]*Image, error)
+
+	// ImagesByRetentionClass returns the images which have the specified
+	// RetentionClass set.
+	ImagesByRetentionClass(class string) ([]Image, error)
+
+	// ExportBigData writes all of an image's big data items to w as a tar
+	// stream, keyed by item name, for backup or export.
+	ExportBigData(id string, w io.Writer) error
+
+	// Counts returns the number of images, names, and distinct digests
+	// currently indexed.
+	Counts() (images, names, digests int)
+
+	// LastSaveSize returns the size in bytes of images.json as of the
+	// most recent successful Save, or 0 if Save has never succeeded.
+	LastSaveSize() int64
+
+	// LastSaveDuration returns how long the most recent successful Save
+	// took to marshal and write images.json, or 0 if Save has never
+	// succeeded.
+	LastSaveDuration() time.Duration
+
+	// TamperedRecords returns the IDs of images whose RecordDigest
+	// didn't match their contents as of the most recent Load.
+	TamperedRecords() []string
+
+	// DuplicateNameConflicts returns the conflicting names found by the
+	// most recent Load, when SetDuplicateNamePolicy was set to
+	// DuplicateNamePolicyReport.  It's empty under the other policies,
+	// since Resolve doesn't leave conflicts standing and Error aborts
+	// Load before a full list can be collected.
+	DuplicateNameConflicts() []DuplicateNameConflict
+
+	// LoadConflicts returns the names the most recent Load reassigned
+	// under DuplicateNamePolicyResolve, the default policy, which
+	// otherwise silently strips a name from the earlier claimant to give
+	// it to the later one.  It's empty under the other two policies,
+	// which don't reassign names during Load.
+	LoadConflicts() []NameConflict
+
+	// BigDataEncryption returns the recorded encryption metadata for a
+	// big data item, if any was set via SetBigDataEncrypted.
+	BigDataEncryption(id, key string) (info BigDataEncryptionInfo, ok bool, err error)
+
+	// ForEachImage calls fn once for a copy of every known image, one at
+	// a time, bounding peak memory to a single Image rather than the
+	// full Images() slice.  See the method's documentation for the
+	// locking tradeoff between the two error-handling modes; pass
+	// stopOnFirstError: true for a plain read-only scan that stops at
+	// the first error, and note that fn must not call back into the
+	// store while the lock it holds is in effect.
+	ForEachImage(fn func(*Image) error, stopOnFirstError bool) error
+
+	// ImagesSharingBigData groups image IDs by the digest of their big
+	// data item stored under key, for deduplication analysis.
+	ImagesSharingBigData(key string) (map[digest.Digest][]string, error)
+
+	// ExistsMany reports, for each of the given IDs or names, whether it
+	// resolves to a known image.
+	ExistsMany(ids []string) map[string]bool
+
+	// NamesForDigest returns the deduplicated union of Names across every
+	// image indexed under digest d.
+	NamesForDigest(d digest.Digest) ([]string, error)
+
+	// NameConflicts reports, for each of names that's currently in use,
+	// the ID of the image that holds it, as a preflight check for tag
+	// operations that want to warn "this will move tag X off image Y"
+	// before committing to the move.  Names with no current holder are
+	// omitted from the result.
+	NameConflicts(names []string) (map[string]string, error)
+
+	// NamesMatching returns every name matching pattern, by
+	// filepath.Match-style globbing, mapped to the ID of the image
+	// holding it.
+	NamesMatching(pattern string) (map[string]string, error)
+
+	// SearchByNamePattern returns copies of every image with at least
+	// one name matching pattern, by filepath.Match-style globbing,
+	// deduplicated for images matching on more than one name.  Unlike
+	// NamesMatching, which reports the matching names themselves, this
+	// is for callers who just want the image records without the cost
+	// of copying and filtering the full result of Images().
+	SearchByNamePattern(pattern string) ([]*Image, error)
+
+	// ByCreatedRange returns copies of every image whose Created falls
+	// within [start, end], inclusive.  Images with a zero Created (as
+	// found in some older records) are silently excluded rather than
+	// counted, since they predate the field and have no timestamp to
+	// compare.  This is meant for retention-window pruning, so callers
+	// don't have to reimplement the scan over Images() themselves.
+	ByCreatedRange(start, end time.Time) ([]*Image, error)
+
+	// ImagesWithBigData returns the images that have a big data item
+	// named key.
+	ImagesWithBigData(key string) ([]*Image, error)
+
+	// ImagesMissingBigData returns the images that don't have a big
+	// data item named key, the complement of ImagesWithBigData.
+	ImagesMissingBigData(key string) ([]*Image, error)
+
+	// ImagesWithoutDigest returns the images with no Digest and no
+	// Digests, typically locally-built images that were never pulled
+	// from or pushed to a registry.
+	ImagesWithoutDigest() ([]*Image, error)
+
+	// ImagesByIDPrefix returns every image whose ID starts with prefix,
+	// using the truncindex's tree to avoid scanning the full image list.
+	// Unlike Get, it never fails on an ambiguous prefix; it's for
+	// interactive UIs that want to show the candidates instead of
+	// picking one.
+	ImagesByIDPrefix(prefix string) ([]*Image, error)
+
+	// Query evaluates q against every index in one pass, starting from
+	// the most selective of NamePrefix and Digest when either is set,
+	// and returns the images matching all of its set predicates.
+	Query(q ImageQuery) ([]Image, error)
+
+	// ImageModifiedSince reports whether the image with the given ID has
+	// been mutated since the caller last observed generation gen, along
+	// with its current generation.  A caller caching one image's
+	// metadata can use this to avoid reloading the whole store just to
+	// check on an unrelated image.
+	ImageModifiedSince(id string, gen uint64) (bool, uint64, error)
+
+	// RemovableImages returns the images with no remaining Names for
+	// which inUse reports false, excluding images pinned via the
+	// "pinned" flag or marked ReadOnly.  It centralizes the "dangling
+	// and unused" check that callers otherwise reimplement against the
+	// layer and container stores themselves.
+	RemovableImages(inUse func(imageID string) bool) ([]*Image, error)
+
+	// ExportOCILayout writes the selected images' manifest and config
+	// big data items into an OCI image layout directory at dir, mapping
+	// big data items to OCI blobs by their stored digests.  It does not
+	// copy layer contents, which remain the layer store's responsibility;
+	// the metadata layout alone is useful for inspection and some
+	// transfer workflows.
+	ExportOCILayout(ids []string, dir string) error
+
+	// ExportJSONL writes one JSON object per line to w, one line per
+	// image for which filter returns true, or every image if filter is
+	// nil, for piping into jq-based tooling without materializing one
+	// huge array.
+	ExportJSONL(w io.Writer, filter func(*Image) bool) error
+
+	// DumpState serializes the store's canonical image list, the source
+	// every derived index is rebuilt from, in a private encoding that is
+	// not images.json and isn't guaranteed stable across versions.  It
+	// exists for callers like test suites in dependent packages that
+	// want to seed a large in-memory store in one shot via LoadState
+	// instead of creating images one at a time.
+	DumpState() ([]byte, error)
+
+	// LoadState replaces the store's in-memory indexes with the ones
+	// encoded in data, as produced by DumpState, rebuilding them in a
+	// single pass without the migration and digest-recomputation work
+	// Load performs when reading images.json from disk.  It does not
+	// touch images.json; callers that want the change to persist must
+	// follow up with Save.
+	LoadState(data []byte) error
+
+	// FindDigestInconsistencies returns the IDs of images whose Digest
+	// isn't present in their own Digests, which can happen if
+	// BigDataDigests was tampered with after the fact.  Such images
+	// would be missed by ByDigest despite claiming the digest.
+	FindDigestInconsistencies() ([]string, error)
+
+	// RepairDigestInconsistencies re-runs recomputeDigests and Saves for
+	// every image FindDigestInconsistencies reports.
+	RepairDigestInconsistencies() ([]string, error)
+
+	// VerifyDigestsAgainst is a read-only consistency probe, intended for
+	// use by `system check`, that cross-checks the digest index against
+	// an external blob store.  It calls exists for every digest that
+	// appears in the index and returns those for which exists reports
+	// false, indicating index entries pointing at blobs that have since
+	// been garbage-collected elsewhere.
+	VerifyDigestsAgainst(exists func(d digest.Digest) (bool, error)) ([]digest.Digest, error)
+
+	// ManifestDigest returns the digest of the image's canonical
+	// manifest, the big data item that identifies the image, without
+	// requiring the caller to already know which key holds it.  If more
+	// than one big data item qualifies (see SetIsManifestKey), it prefers
+	// the one named ImageDigestManifestBigDataNamePrefix; if that still
+	// leaves more than one candidate, it reports an error.
+	ManifestDigest(id string) (digest.Digest, error)
+
+	// DeletionOrder topologically sorts the given image IDs so that, for
+	// any two of them where one's TopLayer appears in the other's
+	// MappedTopLayers, the one referencing it is ordered first.  This
+	// encodes, at the image level, the rule that's otherwise only a
+	// comment on MappedTopLayers, letting a batch rmi remove mapped
+	// layers before the canonical top layer they were derived from.
+	DeletionOrder(ids []string) ([]string, error)
+
+	// LayerReferenceCounts returns, for every layer ID referenced as an
+	// image's TopLayer or one of its MappedTopLayers, the number of
+	// images referencing it.
+	LayerReferenceCounts() (map[string]int, error)
+
+	// ImagesByHistoryLength returns the images whose NamesHistory has at
+	// least min entries, to help identify churn candidates for a
+	// MaxNamesHistory cap.
+	ImagesByHistoryLength(min int) ([]Image, error)
+
+	// ImagesWithFutureCreated returns the images whose Created is after
+	// now, surfacing clock-skew or bad-build-timestamp records that
+	// would otherwise silently break age-based pruning.
+	ImagesWithFutureCreated(now time.Time) ([]*Image, error)
+
+	// LargeBigData returns, per image ID, the names and sizes of big
+	// data items at least minBytes, using BigDataSizes and falling back
+	// to a stat of the on-disk item when a size isn't recorded.
+	LargeBigData(minBytes int64) (map[string]map[string]int64, error)
+
+	// VerifyAll streams verification of every big data item's digest
+	// against its recorded BigDataDigests entry, calling report as it
+	// goes instead of accumulating one large result, so a long scan
+	// surfaces problems incrementally.  It holds only the read lock and
+	// checks ctx between images, so it can be canceled partway through.
+	VerifyAll(ctx context.Context, report func(id, key string, ok bool, err error)) error
+
+	// FindDigestManifestConflicts reports, for every digest indexed by
+	// more than one image, any pair whose on-disk manifest big data
+	// doesn't actually agree byte-for-byte despite being recorded under
+	// the same digest.  Unlike VerifyAll, which checks each item against
+	// its own recorded digest, this is a cross-image check for the
+	// otherwise-impossible case of two different manifests sharing a
+	// digest, which can only arise from corruption or a digest-handling
+	// bug.
+	FindDigestManifestConflicts() ([]DigestConflict, error)
+
+	// DetectNameCollisions compares this store's names against other's,
+	// calling warn once for every name defined in both with the
+	// competing image IDs.  This package doesn't implement a layered
+	// read-only-stores-plus-read-write-store wrapper, so it's exposed
+	// here as a pairwise check that such a wrapper's Load could run
+	// across each pair of stores it manages, to help operators diagnose
+	// "wrong image resolved for tag X" after adding an additional store.
+	DetectNameCollisions(other ROImageStore, warn func(name string, ids []string)) error
+
+	// Begin starts a transaction over a sequence of mutating calls, so
+	// that they persist with one Save() on Commit, or are discarded on
+	// Rollback.
+	Begin() error
+
+	// Commit ends a transaction started with Begin, persisting every
+	// buffered mutation in a single Save().
+	Commit() error
+
+	// Rollback ends a transaction started with Begin, discarding every
+	// buffered mutation and restoring the pre-Begin indexes.
+	Rollback() error
+}
+
+// ImageStore provides bookkeeping for information about Images.
+type ImageStore interface {
+	ROImageStore
+	RWFileBasedStore
+	RWMetadataStore
+	RWImageBigDataStore
+	FlaggableStore
+
+	// Create creates an image that has a specified ID (or a random one) and
+	// optional names, using the specified layer as its topmost (hopefully
+	// read-only) layer.  That layer can be referenced by multiple images.
+	// Against a read-only store, it fails with a *ReadOnlyError.
+	Create(id string, names []string, layer, metadata string, created time.Time, searchableDigest digest.Digest) (*Image, error)
+
+	// CreateComplete is like Create, but also writes every item in
+	// opts.BigData and assigns opts.Names, all under the same Save as
+	// the new record, so that a concurrent Load or lookup never
+	// observes the image before its manifest and names are in place.
+	// It computes the image's digest index from the provided manifest.
+	// This is the entry point for callers who'd otherwise follow Create
+	// with one or more SetBigData calls, each triggering its own Save
+	// and digest recompute.
+	CreateComplete(opts CreateOptions) (*Image, error)
+
+	// SetNames replaces the list of names associated with an image with the
+	// supplied values.  The values are expected to be valid normalized
+	// named image references.  Against a read-only store, it fails with a
+	// *ReadOnlyError.
+	SetNames(id string, names []string) error
+
+	// SetNamesExclusive is like SetNames, but fails with ErrDuplicateName
+	// instead of stealing a name away from whichever other image
+	// currently holds it.
+	SetNamesExclusive(id string, names []string) error
+
+	// SetNamesAndMetadata applies SetNames and SetMetadata as a single
+	// operation under one Save, for callers like `podman commit` that
+	// set both together and want no on-disk state where one has taken
+	// effect but not the other.
+	SetNamesAndMetadata(id string, names []string, metadata string) error
+
+	// MoveName assigns name to toImageID, stealing it away from
+	// whichever image currently holds it, and reports that image's ID,
+	// or "" if the name was unused.  It matches `docker tag`'s
+	// move-not-copy semantics, and unlike SetNames, leaves toImageID's
+	// other names untouched.
+	MoveName(name, toImageID string) (fromImageID string, err error)
+
+	// ReplaceContent atomically swaps in a new TopLayer, big data items,
+	// and Metadata for id, keeping its ID and Names/NamesHistory intact,
+	// for callers (e.g. repeated `podman build` of the same tag) that
+	// want to rebuild an image's content in place rather than creating a
+	// new one.  Big data items not present in bigData are removed;
+	// digests are recomputed from the new content before saving.
+	ReplaceContent(id string, layer string, bigData map[string][]byte, metadata string) error
+
+	// SetRetentionClass sets or clears the RetentionClass label used by
+	// external lifecycle/pruning policies.
+	SetRetentionClass(id, class string) error
+
+	// SetPulled records when the caller retrieved this image, as distinct
+	// from Created.
+	SetPulled(id string, pulled time.Time) error
+
+	// SetExpiry sets or, if expiresAt is the zero time, clears an
+	// image's ExpiresAt, controlling its eligibility for PruneExpired.
+	SetExpiry(id string, expiresAt time.Time) error
+
+	// ClampCreated sets an image's Created to to, for correcting a
+	// record surfaced by ImagesWithFutureCreated whose build timestamp
+	// was bogus.
+	ClampCreated(id string, to time.Time) error
+
+	// PruneExpired deletes every image whose ExpiresAt is non-zero and
+	// in the past, except those pinned via the "pinned" flag or marked
+	// ReadOnly, and returns the IDs it removed.
+	PruneExpired() ([]string, error)
+
+	// SetBigDataTransforms installs optional hooks applied to big data
+	// items on every read and write.
+	SetBigDataTransforms(read, write func(key string, data []byte) ([]byte, error))
+
+	// SetIsManifestKey overrides, for SetBigData and digest recomputation
+	// during Load, the default check of whether a big data item's name
+	// marks it as representative of the image for digest purposes.  Pass
+	// nil to restore the default prefix-based behavior.
+	SetIsManifestKey(isManifestKey func(name string) bool)
+
+	// SetDuplicateNamePolicy controls how Load reacts when two images in
+	// images.json claim the same name.  It defaults to
+	// DuplicateNamePolicyResolve, matching the library's long-standing
+	// behavior.
+	SetDuplicateNamePolicy(policy DuplicateNamePolicy)
+
+	// SetMetadataCAS compares-and-swaps an image's Metadata, writing
+	// newValue only if the current value equals oldValue.
+	SetMetadataCAS(id, oldValue, newValue string) (bool, error)
+
+	// SetComment sets an image's free-text Comment field.
+	SetComment(id, comment string) error
+
+	// SetHidden marks or unmarks an image as excluded from Images() by
+	// default.
+	SetHidden(id string, hidden bool) error
+
+	// SetRootFSSize sets the cached uncompressed layer size for an
+	// image.  Pass -1 to mark it unknown again.
+	SetRootFSSize(id string, size int64) error
+
+	// SetDiffIDs caches the ordered list of layer diff IDs making up the
+	// image's layer stack, for ByDiffID.  Pass nil to clear it.
+	SetDiffIDs(id string, diffIDs []digest.Digest) error
+
+	// SetScanStatus records that a security scanner examined this image
+	// at scanned, with result status, for ImagesNeedingScan.  The store
+	// doesn't interpret status; that's the caller's responsibility.
+	SetScanStatus(id string, scanned time.Time, status string) error
+
+	// SetLabel sets key to value in the image's Labels map, creating the
+	// map if it's nil.  Unlike Metadata, which holds one opaque caller
+	// value, Labels is meant for structured provenance such as build
+	// host or pipeline ID attached under distinct keys.
+	SetLabel(id, key, value string) error
+
+	// RemoveLabel deletes key from the image's Labels map, if present.
+	RemoveLabel(id, key string) error
+
+	// Labels returns a copy of the image's Labels map, which may be nil
+	// if none have been set.
+	Labels(id string) (map[string]string, error)
+
+	// BackfillBigDataSizes stats every item in the image's BigDataNames
+	// that's missing from BigDataSizes, and records its on-disk size,
+	// fixing size reporting for records written by older versions of
+	// this library that didn't persist sizes consistently.
+	BackfillBigDataSizes(id string) error
+
+	// RebuildFromDataDirs is a disaster-recovery repair pass for stores
+	// whose images.json survived but lost its BigDataDigests (and
+	// possibly BigDataSizes): it re-reads each big data item named in
+	// every image's BigDataNames from disk, recomputes its size and
+	// digest using digestManifest for manifest items, rebuilds the
+	// digest-based index, and Saves once.
+	RebuildFromDataDirs(digestManifest func([]byte) (digest.Digest, error)) error
+
+	// BackfillAllBigDataSizes calls BackfillBigDataSizes for every
+	// image, for use as a one-time repair pass after upgrading a store
+	// that predates BigDataSizes.
+	BackfillAllBigDataSizes() error
+
+	// SetDefaultTagLookup controls whether lookup by a bare name (one
+	// with neither a tag nor a digest) that doesn't directly resolve
+	// also tries appending ":latest" before giving up.  It's disabled by
+	// default so that callers who deliberately store bare names aren't
+	// affected.
+	SetDefaultTagLookup(enabled bool)
+
+	// SetFlags merges flags into an image's Flags in a single Save,
+	// instead of requiring one SetFlag call (and Save) per key.  It
+	// rejects any key in ReservedFlagKeys.
+	SetFlags(id string, flags map[string]interface{}) error
+
+	// ClearFlags removes several keys from an image's Flags in a single
+	// Save.
+	ClearFlags(id string, keys []string) error
+
+	// SetLockRetryPolicy configures Lock and RLock to retry, with
+	// backoff between attempts, instead of failing on the first
+	// transient acquisition failure.
+	SetLockRetryPolicy(maxAttempts int, backoff time.Duration)
+
+	// RelabelDataDir applies the given SELinux label to an image's
+	// datadir and its contents.  It's a no-op on systems where SELinux
+	// isn't enabled.
+	RelabelDataDir(id string, label string) error
+
+	// SetOnSaveError installs a callback invoked with the original error
+	// whenever Save fails, without swallowing or altering it, so callers
+	// can centralize alerting instead of wrapping every mutation site.
+	SetOnSaveError(onError func(error))
+
+	// AddEventSink registers sink to receive an ImageEvent, from a
+	// dedicated goroutine, after each committed mutation (Create,
+	// CreateComplete, Delete, or anything that sets a field via a
+	// Set* method).  Multiple sinks may be installed; each gets every
+	// event.  A sink whose delivery buffer fills because it's slow or
+	// blocked loses events rather than stalling Save; see
+	// DroppedEvents.  Its dedicated goroutine runs until RemoveEventSink
+	// is called for the same sink, or the store is shut down; a sink
+	// that's no longer wanted must be removed explicitly or it leaks for
+	// the life of the process.
+	AddEventSink(sink EventSink)
+
+	// RemoveEventSink stops and discards every worker previously
+	// installed for sink via AddEventSink, so its delivery goroutine
+	// exits.  It's a no-op if sink was never added.  Comparability of
+	// sink follows normal Go interface equality rules.
+	RemoveEventSink(sink EventSink)
+
+	// DroppedEvents returns how many ImageEvents have been dropped
+	// across all installed EventSinks because a sink's delivery buffer
+	// was full.
+	DroppedEvents() uint64
+
+	// ImageLock returns a Locker private to the named image, distinct
+	// from the store-wide lock, for callers doing big-data-only work
+	// (e.g. around BigData/SetBigData) that doesn't touch the shared
+	// indexes or images.json.  Holding just this lock around such an
+	// operation lets unrelated images be read or written concurrently
+	// instead of serializing behind the store's single write lock.  It
+	// is not a substitute for the store lock for anything that mutates
+	// the indexes or calls Save; those still need it, same as today.
+	ImageLock(id string) (Locker, error)
+
+	// SetNameNormalizer installs a function mapping a name to the
+	// canonical form of the reference it identifies, so that Create and
+	// SetNames can collapse names that normalize to the same reference
+	// (e.g. "ubuntu" and "docker.io/library/ubuntu:latest") into a
+	// single entry instead of only deduping exact string duplicates.
+	// Load also uses it to collapse equivalents in existing records.
+	SetNameNormalizer(normalize func(name string) (string, error))
+
+	// SetRegistryHostParser installs a function that extracts the
+	// hostname portion of a name reference, for ImagesByRegistry to use
+	// when deciding whether a name belongs to a given registry.  Pass
+	// nil to restore the default, which treats the segment before the
+	// first "/" as the hostname when it looks like one (contains "." or
+	// ":", or is "localhost"), matching normalizeNameHostname.
+	SetRegistryHostParser(parse func(name string) (string, error))
+
+	// SetIndentJSON controls whether Save pretty-prints images.json.
+	SetIndentJSON(indent bool)
+
+	// AdoptBigData adopts a file already present on disk at srcPath as a
+	// big data item for id, without ever loading its full contents into
+	// memory, verifying its digest against expectedDigest in the
+	// process.
+	AdoptBigData(id, key, srcPath string, expectedDigest digest.Digest) error
+
+	// ImportBigData restores an image's big data items from a tar stream
+	// produced by ExportBigData.
+	ImportBigData(id string, tarball io.Reader) error
+
+	// SetSkipSync controls whether writes to big data items and
+	// images.json are fsynced.
+	SetSkipSync(skip bool)
+
+	// SetSaveDebounce configures Save to mark the store dirty and return
+	// immediately, flushing at most once per window from a background
+	// timer, instead of writing images.json on every call.  This trades
+	// a small durability window for far fewer fsyncs on daemons that
+	// mutate images rapidly.  Pass 0 to disable it (the default), which
+	// makes Save persist synchronously as before.  Load and
+	// ReloadIfChanged flush a pending write themselves before replacing
+	// the in-memory state, so a debounce window in progress doesn't lose
+	// a mutation to a reload; Flush forces a pending write immediately,
+	// and callers should still call it during shutdown, since nothing
+	// else does once the process is exiting.
+	SetSaveDebounce(debounce time.Duration)
+
+	// Flush immediately persists any mutation still pending from a
+	// debounced Save (see SetSaveDebounce), holding the store lock for
+	// the duration of the write so cross-process readers never observe
+	// a partial flush.  It's a no-op if nothing is pending, including
+	// when debouncing isn't enabled.  Load and ReloadIfChanged call this
+	// internally before reloading, so callers only need it directly for
+	// an explicit flush point such as shutdown.
+	Flush() error
+
+	// SetMinFreeBytes configures SetBigData to check, before writing,
+	// that at least minFree bytes remain available on the datadir's
+	// filesystem, returning ErrInsufficientSpace instead of attempting
+	// the write if there isn't.  Pass 0 to disable the check (the
+	// default).  The check is skipped on platforms where available
+	// space can't be determined.
+	SetMinFreeBytes(minFree int64)
+
+	// SetKeepBackups configures save to rotate up to keep prior copies of
+	// images.json out of the way, as images.json.1 through
+	// images.json.keep (oldest highest-numbered), before writing the new
+	// one, so a corrupt Load has something to recover from. Pass 0 to
+	// disable rotation (the default). This is a recovery path distinct
+	// from RecordDigest-based corruption detection; it doesn't quarantine
+	// anything, it just keeps history.
+	SetKeepBackups(keep int)
+
+	// SetMaxNamesHistory caps NamesHistory at max entries, dropping the
+	// oldest once a name add would exceed it.  Pass 0 to leave it
+	// unbounded (the default).  It only affects future name changes; it
+	// doesn't retroactively trim NamesHistory on images that already
+	// exceed max.
+	SetMaxNamesHistory(max int)
+
+	// SetDisableTruncIndex controls whether Load builds idindex, the
+	// structure that resolves truncated IDs.  Building it is pure
+	// overhead for callers, such as some test harnesses or API servers,
+	// that always address images by full ID; pass true to skip it for
+	// faster Loads.  With it disabled, lookups by truncated ID fail with
+	// ErrImageUnknown instead of resolving.  It defaults to false.
+	SetDisableTruncIndex(disable bool)
+
+	// SetCacheSize enables a bounded LRU cache of up to size recently
+	// Get'd images, served without a copyImage on a hit, to cut
+	// allocation churn for daemons that repeatedly look up the same hot
+	// images.  Pass 0 to disable it (the default).  Entries are dropped
+	// whenever the image they reflect is mutated, deleted, or the store
+	// is reloaded, so a cache hit is always as current as a cache miss
+	// would be.  The *Image returned on a cache hit is shared with other
+	// concurrent callers and, unlike a cache miss's freshly copied
+	// result, must be treated as read-only.
+	SetCacheSize(size int)
+
+	// SetBigDataNameHashing controls whether new big data items get a
+	// short sha256-derived file name instead of makeBigDataBaseName's
+	// escaped form of their key, so that long or unusually-charactered
+	// keys (e.g. signature/attestation names) can't produce a file name
+	// that's rejected or truncated by the underlying filesystem.  It's
+	// disabled by default and affects only items written after it's
+	// enabled; use MigrateBigDataFileNames to convert existing items.
+	SetBigDataNameHashing(enabled bool)
+
+	// MigrateBigDataFileNames renames every big data item belonging to
+	// id that's still using the legacy makeBigDataBaseName scheme over
+	// to the hashed scheme enabled by SetBigDataNameHashing, recording
+	// the new name in BigDataFileNames and saving once it's done.  It's
+	// a no-op, not an error, if name hashing isn't enabled.
+	MigrateBigDataFileNames(id string) error
+
+	// MigrateAllBigDataFileNames calls MigrateBigDataFileNames for
+	// every image, for use as a one-time migration after turning name
+	// hashing on for a store that has existing big data items.
+	MigrateAllBigDataFileNames() error
+
+	// SetBigDataEncrypted stores ciphertext for a big data item along
+	// with the digest of its plaintext and the key/algorithm used.
+	SetBigDataEncrypted(id, key string, ciphertext []byte, plaintextDigest digest.Digest, keyID, algorithm string) error
+
+	// SetBigDataFromReader is like SetBigData, but streams src to disk
+	// instead of requiring the caller to buffer the whole payload first.
+	// Manifest-named keys are still buffered internally, since
+	// digestManifest needs the complete bytes.
+	SetBigDataFromReader(id, key string, src io.Reader, digestManifest func([]byte) (digest.Digest, error)) error
+
+	// RenameBigData renames a big data item without rewriting its
+	// contents, updating BigDataSizes/BigDataDigests/BigDataNames and,
+	// for manifest-like keys, the digest index to match.  It fails if
+	// newKey already names an item.
+	RenameBigData(id, oldKey, newKey string) error
+
+	// DeleteBigData removes a big data item and its
+	// BigDataSizes/BigDataDigests/BigDataNames entries, refreshing the
+	// digest index if key was manifest-like.
+	DeleteBigData(id, key string) error
+
+	// Delete removes the record of the image.  Against a read-only
+	// store, it fails with a *ReadOnlyError.
+	Delete(id string) error
+
+	// DeleteMany removes the records of multiple images as a single unit:
+	// it orders the deletable ids via DeletionOrder, honors opts, deletes
+	// each in turn, and Saves once at the end instead of once per image.
+	// An unknown ID, or one that opts or a pinned/read-only flag protects,
+	// is recorded in the returned error but doesn't stop the rest of the
+	// batch. It returns the IDs it successfully deleted.
+	//
+	// Save is called exactly once, after every deletable image has been
+	// removed from the in-memory indexes, so a crash before that point
+	// leaves images.json untouched. Each deleted image's data directory
+	// is only removed after that Save succeeds, though, so a crash
+	// between the Save and the RemoveAll calls can leave orphaned data
+	// directories on disk for images images.json no longer lists.
+	DeleteMany(ids []string, opts DeleteOptions) ([]string, error)
+
+	// Wipe removes records of all images.
+	Wipe() error
+
+	// ReconcileTo makes the store match desired: creating images missing
+	// from it, updating the names and metadata of ones that differ, and,
+	// if policy.DeleteExtras is set, deleting images absent from desired
+	// that policy doesn't protect.  It reports every action it took, in
+	// the order taken, and if a step fails, it stops there and returns
+	// the report describing what succeeded so far alongside the error,
+	// rather than leaving the caller to guess how far it got.
+	ReconcileTo(desired []Image, policy ReconcilePolicy) (ReconcileReport, error)
+}
+
+type imageStore struct {
+	lockfile Locker
+	dir      string
+	images   []*Image
+	idindex  *truncindex.TruncIndex
+	byid     map[string]*Image
+	byname   map[string]*Image
+	bydigest map[digest.Digest][]*Image
+	loadMut  sync.Mutex
+
+	// skipSync, when true, skips the fsync normally performed when
+	// writing big data items and images.json.  It trades durability for
+	// speed, and is intended for ephemeral stores (e.g. CI) that get
+	// recreated on every run and have nothing to lose on a crash.
+	skipSync bool
+
+	// inTransaction is true between a Begin() and its matching Commit()
+	// or Rollback(), during which Save() buffers rather than persists.
+	inTransaction bool
+
+	// tamperedRecords holds the IDs of images whose RecordDigest didn't
+	// match their contents as of the most recent Load.  See
+	// TamperedRecords.
+	tamperedRecords []string
+
+	// lastSaveSize and lastSaveDuration record the size of images.json
+	// and how long writing it took, as of the most recent successful
+	// save() call, for LastSaveSize and LastSaveDuration.
+	lastSaveSize     int64
+	lastSaveDuration time.Duration
+
+	// bigDataReadTransform and bigDataWriteTransform, if set, are applied
+	// to big data items on every read and write, respectively.  See
+	// SetBigDataTransforms.
+	bigDataReadTransform  func(key string, data []byte) ([]byte, error)
+	bigDataWriteTransform func(key string, data []byte) ([]byte, error)
+
+	// isManifestKey, if set, overrides bigDataNameIsManifest for deciding
+	// which big data item names are representative of the image for
+	// digest purposes.  See SetIsManifestKey.
+	isManifestKey func(name string) bool
+
+	// duplicateNamePolicy controls how Load reacts when two images in
+	// images.json claim the same name.  See SetDuplicateNamePolicy.
+	duplicateNamePolicy DuplicateNamePolicy
+
+	// duplicateNameConflicts holds the conflicts found by the most recent
+	// Load when duplicateNamePolicy is DuplicateNamePolicyReport.  See
+	// DuplicateNameConflicts.
+	duplicateNameConflicts []DuplicateNameConflict
+
+	// loadNameConflicts holds the names the most recent Load reassigned
+	// under DuplicateNamePolicyResolve.  See LoadConflicts.
+	loadNameConflicts []NameConflict
+
+	// indentJSON, when true, causes Save to pretty-print images.json for
+	// human inspection.  Load parses either form fine.
+	indentJSON bool
+
+	// generations counts, per image ID, how many times that image's
+	// record has been mutated in this process's lifetime.  It is purely
+	// in-memory bookkeeping for ImageModifiedSince and isn't persisted;
+	// after a restart, generations start over from zero.
+	generations map[string]uint64
+
+	// lockMaxAttempts and lockBackoff configure Lock/RLock's retry
+	// behavior.  See SetLockRetryPolicy.
+	lockMaxAttempts int
+	lockBackoff     time.Duration
+
+	// onSaveError, if set, is invoked with the original error whenever
+	// Save fails, so that daemons can emit metrics/alerts without
+	// wrapping every mutation site.  See SetOnSaveError.
+	onSaveError func(error)
+
+	// nameNormalizer, if set, maps a name to the canonical form of the
+	// reference it identifies (e.g. "ubuntu" and
+	// "docker.io/library/ubuntu:latest" might both normalize to the
+	// latter), so that Create and SetNames can collapse equivalent names
+	// to one entry instead of only deduping exact string duplicates.
+	// See SetNameNormalizer.
+	nameNormalizer func(name string) (string, error)
+
+	// registryHostParser, if set, extracts the hostname portion of a
+	// name for ImagesByRegistry.  See SetRegistryHostParser.
+	registryHostParser func(name string) (string, error)
+
+	// bigDataLocksMu guards bigDataLocks, the map of per-image RWMutexes
+	// used to reduce blocking between BigData reads and SetBigData
+	// writes on different images.  See bigDataLock.
+	bigDataLocksMu sync.Mutex
+	bigDataLocks   map[string]*sync.RWMutex
+
+	// eventSinks delivers ImageEvents for every committed mutation to
+	// each installed EventSink.  See AddEventSink.
+	eventSinks []*eventSinkWorker
+
+	// pendingEvents holds the ImageEvents queued by mutations since the
+	// last successful save(), in commit order, so that a transaction or
+	// a debounced Save publishes them only once the write they describe
+	// actually lands on disk.  See queueEvent.
+	pendingEvents []ImageEvent
+
+	// saveDebounce, when nonzero, makes Save mark the store dirty and
+	// coalesce further Saves arriving within this window into a single
+	// deferred write, instead of persisting on every call.  See
+	// SetSaveDebounce.
+	saveDebounce time.Duration
+
+	// saveMu guards saveDirty and saveTimer, which the debounced flush
+	// goroutine started by Save touches independently of whatever
+	// caller is holding the store lock at the time.
+	saveMu sync.Mutex
+
+	// saveDirty is true when a debounced Save is pending flush.  See
+	// Flush.
+	saveDirty bool
+
+	// saveTimer fires the deferred flush for a pending debounced Save,
+	// or is nil when none is pending.
+	saveTimer *time.Timer
+
+	// minFreeBytes, when nonzero, makes SetBigData check available space
+	// on the datadir's filesystem before writing and fail early with
+	// ErrInsufficientSpace instead of leaving a partial write behind.
+	// See SetMinFreeBytes.
+	minFreeBytes int64
+
+	// keepBackups, when nonzero, makes save rotate up to that many prior
+	// copies of images.json out of the way, as images.json.1 through
+	// images.json.N, before writing the new one.  See SetKeepBackups.
+	keepBackups int
+
+	// disableTruncIndex, when true, skips building idindex on Load,
+	// trading away truncated-ID resolution for faster startup.  See
+	// SetDisableTruncIndex.
+	disableTruncIndex bool
+
+	// cache, if non-nil, holds recently Get'd images so repeat lookups
+	// don't pay for a copyImage.  It's disabled (nil) by default.  See
+	// SetCacheSize.
+	cache *imageCache
+
+	// bigDataNameHashingEnabled, when true, makes new big data items get
+	// a short sha256-derived file name instead of makeBigDataBaseName's
+	// escaped form of the key, to keep long or unusually-charactered
+	// keys (e.g. signature/attestation names) from producing unusable
+	// file names.  See SetBigDataNameHashing and MigrateBigDataFileNames.
+	bigDataNameHashingEnabled bool
+
+	// defaultTagEnabled, when true, makes lookup() also try appending
+	// ":latest" to a bare name (one with neither a tag nor a digest)
+	// that doesn't otherwise resolve, matching how users expect
+	// untagged shorthand to behave.  It defaults to false so that
+	// callers who deliberately store bare names aren't affected.  See
+	// SetDefaultTagLookup.
+	defaultTagEnabled bool
+
+	// maxNamesHistory caps the length of NamesHistory, when positive.
+	// addNameToHistory drops the oldest entries once it's exceeded. Zero
+	// (the default) leaves NamesHistory unbounded.  See
+	// SetMaxNamesHistory.
+	maxNamesHistory int
+
+	// lastLoadErr records the error, if any, returned by the most recent
+	// Load, including ones triggered internally by ReloadIfChanged.  See
+	// LastLoadError.
+	lastLoadErr error
+}
+
+// dedupeNormalizedNames collapses names that normalize to the same
+// canonical form into a single entry, using r.nameNormalizer.  If no
+// normalizer is set, it returns names unchanged.
+func (r *imageStore) dedupeNormalizedNames(names []string) ([]string, error) {
+	if r.nameNormalizer == nil {
+		return names, nil
+	}
+	seen := make(map[string]struct{}, len(names))
+	deduped := make([]string, 0, len(names))
+	for _, name := range names {
+		canonical, err := r.nameNormalizer(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error normalizing name %q", name)
+		}
+		if canonical == "" {
+			canonical = name
+		}
+		if _, ok := seen[canonical]; ok {
+			continue
+		}
+		seen[canonical] = struct{}{}
+		deduped = append(deduped, canonical)
+	}
+	return deduped, nil
+}
+
+// imageCache is a small bounded LRU, keyed by the id or name a caller
+// passed to Get, that holds ready-to-return *Image copies so that repeat
+// Gets of the same hot images don't pay for a copyImage.  See
+// (*imageStore).SetCacheSize.
+type imageCache struct {
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type imageCacheEntry struct {
+	key   string
+	image *Image
+}
+
+func newImageCache(capacity int) *imageCache {
+	return &imageCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *imageCache) get(key string) (*Image, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*imageCacheEntry).image, true
+}
+
+func (c *imageCache) add(key string, image *Image) {
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*imageCacheEntry).image = image
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&imageCacheEntry{key: key, image: image})
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*imageCacheEntry).key)
+	}
+}
+
+func (c *imageCache) clear() {
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// bumpGeneration records that the image with the given ID was just
+// mutated, for the benefit of ImageModifiedSince, and drops any cached Get
+// results, since they're now stale.  It also queues an ImageEventUpdated
+// for id; call bumpGenerationAs instead at a call site (Create,
+// CreateComplete, Delete) that knows a more specific event type applies.
+func (r *imageStore) bumpGeneration(id string) {
+	r.bumpGenerationAs(id, ImageEventUpdated)
+}
+
+// bumpGenerationAs is bumpGeneration, but queues an event of type t
+// instead of always assuming ImageEventUpdated.
+func (r *imageStore) bumpGenerationAs(id string, t ImageEventType) {
+	if r.generations == nil {
+		r.generations = make(map[string]uint64)
+	}
+	r.generations[id]++
+	r.invalidateCache()
+	r.queueEvent(t, id)
+}
+
+// queueEvent buffers an ImageEvent to be published to every installed
+// EventSink once the mutation it describes is actually committed to disk
+// by a successful save().  See pendingEvents.
+func (r *imageStore) queueEvent(t ImageEventType, id string) {
+	r.pendingEvents = append(r.pendingEvents, ImageEvent{Type: t, ID: id})
+}
+
+// publishPendingEvents delivers every queued ImageEvent to each installed
+// EventSink, in commit order, and clears the queue.  Callers must call it
+// only after the mutations the events describe are durably committed.
+func (r *imageStore) publishPendingEvents() {
+	if len(r.pendingEvents) == 0 {
+		return
+	}
+	events := r.pendingEvents
+	r.pendingEvents = nil
+	for _, event := range events {
+		for _, sink := range r.eventSinks {
+			sink.publish(event)
+		}
+	}
+}
+
+// AddEventSink registers sink to receive an ImageEvent after each
+// committed mutation, delivered from a dedicated goroutine so that a slow
+// or blocked sink can't stall Save; see EventSink and DroppedEvents.
+// Multiple sinks may be installed, and each receives every event.
+func (r *imageStore) AddEventSink(sink EventSink) {
+	r.eventSinks = append(r.eventSinks, newEventSinkWorker(sink))
+}
+
+// RemoveEventSink stops and discards every worker installed for sink,
+// closing its delivery goroutine.  It's a no-op if sink was never added.
+func (r *imageStore) RemoveEventSink(sink EventSink) {
+	remaining := r.eventSinks[:0]
+	for _, worker := range r.eventSinks {
+		if worker.sink == sink {
+			worker.close()
+			continue
+		}
+		remaining = append(remaining, worker)
+	}
+	r.eventSinks = remaining
+}
+
+// stopEventSinks closes every installed EventSink worker's delivery
+// goroutine, discarding any events still queued.  It's called on store
+// shutdown so a repeatedly opened-and-closed store doesn't leak one
+// goroutine per AddEventSink call across its lifetime.
+func (r *imageStore) stopEventSinks() {
+	for _, worker := range r.eventSinks {
+		worker.close()
+	}
+	r.eventSinks = nil
+}
+
+// DroppedEvents returns the total number of ImageEvents dropped across all
+// installed EventSinks because a sink's delivery buffer was full.
+func (r *imageStore) DroppedEvents() uint64 {
+	var total uint64
+	for _, sink := range r.eventSinks {
+		total += atomic.LoadUint64(&sink.dropped)
+	}
+	return total
+}
+
+// invalidateCache drops every entry from the Get cache, if one is enabled.
+// It's called whenever an image record is mutated, deleted, or reloaded
+// from disk, since a cached copy wouldn't reflect the change.
+func (r *imageStore) invalidateCache() {
+	if r.cache != nil {
+		r.cache.clear()
+	}
+}
+
+// SetIndentJSON controls whether Save pretty-prints images.json, which is
+// handy for operators debugging storage issues by hand.  It defaults to
+// false (compact, single-line JSON).
+func (r *imageStore) SetIndentJSON(indent bool) {
+	r.indentJSON = indent
+}
+
+// Begin starts a transaction over a sequence of otherwise-independent
+// mutating calls (e.g. Create, SetMetadata), so that they can be persisted
+// with a single Save() on Commit, or discarded entirely on Rollback.  This
+// only covers the in-memory index and images.json: big-data methods
+// (SetBigData, SetBigDataFromReader, SetBigDataEncrypted, DeleteBigData,
+// RenameBigData, AdoptBigData, ImportBigData) write, rename, or delete their
+// on-disk blob immediately, regardless of any transaction in progress, and
+// are not undone by Rollback; see Rollback's doc comment.  The caller must
+// already hold the store's write lock for the whole transaction, and must
+// follow up with exactly one of Commit or Rollback.  Nesting is not
+// supported.
+func (r *imageStore) Begin() error {
+	if r.inTransaction {
+		return errors.New("a transaction is already in progress for the image store")
+	}
+	r.inTransaction = true
+	return nil
+}
+
+// Commit ends a transaction started with Begin, persisting every buffered
+// mutation in a single Save().
+func (r *imageStore) Commit() error {
+	if !r.inTransaction {
+		return errors.New("no transaction is in progress for the image store")
+	}
+	r.inTransaction = false
+	return r.save()
+}
+
+// Rollback ends a transaction started with Begin, discarding every buffered
+// mutation to the in-memory index.  Because Save() was never actually
+// invoked during the transaction, images.json on disk is still exactly as
+// it was before Begin, so reloading from it restores the pre-Begin indexes
+// precisely.  Rollback cannot undo big-data file I/O: any SetBigData,
+// SetBigDataFromReader, SetBigDataEncrypted, DeleteBigData, RenameBigData,
+// AdoptBigData, or ImportBigData call made during the transaction has
+// already written, renamed, or deleted its on-disk blob and stays that way
+// after Rollback, even though the metadata referencing it reverts. Callers
+// that need all-or-nothing semantics for big data must stage their own
+// backup of any blob they're about to overwrite or remove.
+func (r *imageStore) Rollback() error {
+	if !r.inTransaction {
+		return errors.New("no transaction is in progress for the image store")
+	}
+	r.inTransaction = false
+	r.pendingEvents = nil
+	return r.Load()
+}
+
+// SetSkipSync controls whether writes to big data items and images.json are
+// fsynced.  It defaults to false (always sync); set it to true for
+// ephemeral stores where durability doesn't matter and the extra fsyncs
+// only slow things down.
+func (r *imageStore) SetSkipSync(skip bool) {
+	r.skipSync = skip
+}
+
+// SetIsManifestKey installs a hook through which callers can override which
+// big data item names are considered to be representative of the image, in
+// that their digest can also be said to be the image's digest.  It is
+// consulted by SetBigData and by digest recomputation during Load, in place
+// of the default bigDataNameIsManifest prefix check.  Pass nil to restore
+// the default behavior.
+func (r *imageStore) SetIsManifestKey(isManifestKey func(name string) bool) {
+	r.isManifestKey = isManifestKey
+}
+
+// isManifest reports whether name is considered representative of the
+// image, using the hook installed via SetIsManifestKey if one is set, and
+// falling back to bigDataNameIsManifest otherwise.
+func (r *imageStore) isManifest(name string) bool {
+	if r.isManifestKey != nil {
+		return r.isManifestKey(name)
+	}
+	return bigDataNameIsManifest(name)
+}
+
+// SetDuplicateNamePolicy controls how Load reacts when two images in
+// images.json claim the same name.  It defaults to
+// DuplicateNamePolicyResolve.
+func (r *imageStore) SetDuplicateNamePolicy(policy DuplicateNamePolicy) {
+	r.duplicateNamePolicy = policy
+}
+
+// SetMinFreeBytes configures SetBigData to check, before writing, that at
+// least minFree bytes remain available on the datadir's filesystem.  It
+// defaults to 0, which disables the check.
+func (r *imageStore) SetMinFreeBytes(minFree int64) {
+	r.minFreeBytes = minFree
+}
+
+// SetKeepBackups configures save to rotate up to keep prior copies of
+// images.json out of the way before writing the new one.  It defaults to 0,
+// which disables rotation.
+func (r *imageStore) SetKeepBackups(keep int) {
+	r.keepBackups = keep
+}
+
+// SetMaxNamesHistory caps NamesHistory at max entries going forward.  It
+// defaults to 0, which leaves NamesHistory unbounded.
+func (r *imageStore) SetMaxNamesHistory(max int) {
+	r.maxNamesHistory = max
+}
+
+// SetDisableTruncIndex controls whether Load builds idindex.  It defaults
+// to false.
+func (r *imageStore) SetDisableTruncIndex(disable bool) {
+	r.disableTruncIndex = disable
+}
+
+// SetCacheSize enables or resizes the Get cache; see the ImageStore
+// interface for the invalidation contract it upholds.  It defaults to
+// disabled (size 0).  Shrinking or disabling the cache discards whatever
+// it currently holds.
+func (r *imageStore) SetCacheSize(size int) {
+	if size <= 0 {
+		r.cache = nil
+		return
+	}
+	r.cache = newImageCache(size)
+}
+
+// SetBigDataNameHashing controls whether new big data items get a short
+// sha256-derived file name instead of makeBigDataBaseName's escaped form
+// of their key.  It defaults to false.
+func (r *imageStore) SetBigDataNameHashing(enabled bool) {
+	r.bigDataNameHashingEnabled = enabled
+}
+
+// MigrateBigDataFileNames renames every big data item belonging to id
+// that's still using the legacy makeBigDataBaseName scheme over to the
+// hashed scheme, and saves once if it renamed anything.  It's a no-op if
+// name hashing isn't enabled.
+func (r *imageStore) MigrateBigDataFileNames(id string) error {
+	if !r.bigDataNameHashingEnabled {
+		return nil
+	}
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image big data file names at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	save := false
+	for _, key := range image.BigDataNames {
+		if _, ok := image.BigDataFileNames[key]; ok {
+			continue
+		}
+		oldPath := r.datapath(image.ID, key)
+		newName := r.assignBigDataBaseName(image, key)
+		newPath := filepath.Join(r.datadir(image.ID), newName)
+		if oldPath == newPath {
+			continue
+		}
+		if err := os.Rename(oldPath, newPath); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrapf(err, "error migrating big data item %q to hashed file name", key)
+		}
+		save = true
+	}
+	if !save {
+		return nil
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// MigrateAllBigDataFileNames calls MigrateBigDataFileNames for every
+// image, for use as a one-time migration after turning name hashing on
+// for a store that has existing big data items.
+func (r *imageStore) MigrateAllBigDataFileNames() error {
+	var result *multierror.Error
+	for _, image := range r.images {
+		if err := r.MigrateBigDataFileNames(image.ID); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+func (r *imageStore) atomicWriteFile(path string, data []byte, perm os.FileMode) error {
+	w, err := ioutils.NewAtomicFileWriterWithOpts(path, perm, &ioutils.AtomicFileWriterOptions{NoSync: r.skipSync})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// atomicWriteJSON streams the JSON encoding of v straight to path through an
+// atomic file writer, the same rename-on-close semantics as atomicWriteFile,
+// but without first marshaling into an intermediate []byte, which matters
+// for images.json once the store holds thousands of records. It returns the
+// number of bytes written.
+func (r *imageStore) atomicWriteJSON(path string, v interface{}, perm os.FileMode) (int64, error) {
+	w, err := ioutils.NewAtomicFileWriterWithOpts(path, perm, &ioutils.AtomicFileWriterOptions{NoSync: r.skipSync})
+	if err != nil {
+		return 0, err
+	}
+	counter := ioutils.NewWriteCounter(w)
+	enc := json.NewEncoder(counter)
+	if r.indentJSON {
+		enc.SetIndent("", "    ")
+	}
+	if err := enc.Encode(v); err != nil {
+		w.Close()
+		return 0, err
+	}
+	return counter.Count, w.Close()
+}
+
+// wrapFSError maps a raw OS error from a big-data or images.json file
+// operation into one of the package's exported sentinels, so that callers
+// can match on it with errors.Is instead of on OS-specific message text or
+// *os.PathError internals.  notFound, if non-nil, is the sentinel to use
+// when err indicates a missing file at this particular call site; errors
+// wrapFSError doesn't recognize are returned unchanged.
+func wrapFSError(err error, notFound error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case os.IsPermission(err):
+		return errors.Wrapf(ErrStorePermission, "%v", err)
+	case notFound != nil && os.IsNotExist(err):
+		return errors.Wrapf(notFound, "%v", err)
+	case system.IsOutOfSpace(err):
+		return errors.Wrapf(ErrInsufficientSpace, "%v", err)
+	}
+	return err
+}
+
+func copyImage(i *Image) *Image {
+	return &Image{
+		ID:                i.ID,
+		Digest:            i.Digest,
+		Digests:           copyDigestSlice(i.Digests),
+		Names:             copyStringSlice(i.Names),
+		NamesHistory:      copyStringSlice(i.NamesHistory),
+		TopLayer:          i.TopLayer,
+		MappedTopLayers:   copyStringSlice(i.MappedTopLayers),
+		Metadata:          i.Metadata,
+		BigDataNames:      copyStringSlice(i.BigDataNames),
+		BigDataSizes:      copyStringInt64Map(i.BigDataSizes),
+		BigDataDigests:    copyStringDigestMap(i.BigDataDigests),
+		Created:           i.Created,
+		ReadOnly:          i.ReadOnly,
+		Flags:             copyStringInterfaceMap(i.Flags),
+		RetentionClass:    i.RetentionClass,
+		Pulled:            i.Pulled,
+		BigDataEncryption: copyBigDataEncryptionMap(i.BigDataEncryption),
+		Comment:           i.Comment,
+		Hidden:            i.Hidden,
+		RootFSSize:        copyInt64Ptr(i.RootFSSize),
+		BigDataFileNames:  copyStringStringMap(i.BigDataFileNames),
+		RecordDigest:      i.RecordDigest,
+		ExpiresAt:         i.ExpiresAt,
+		DiffIDs:           copyDigestSlice(i.DiffIDs),
+		LastScanned:       i.LastScanned,
+		ScanStatus:        i.ScanStatus,
+		Labels:            copyStringStringMap(i.Labels),
+	}
+}
+
+func copyBigDataEncryptionMap(m map[string]BigDataEncryptionInfo) map[string]BigDataEncryptionInfo {
+	if m == nil {
+		return nil
+	}
+	cp := make(map[string]BigDataEncryptionInfo, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+func copyImageSlice(slice []*Image) []*Image {
+	if len(slice) > 0 {
+		cp := make([]*Image, len(slice))
+		for i := range slice {
+			cp[i] = copyImage(slice[i])
+		}
+		return cp
+	}
+	return nil
+}
+
+// Images returns every known image except those marked Hidden.  Use
+// ImagesFiltered with IncludeHidden: true to also see hidden images.
+func (r *imageStore) Images() ([]Image, error) {
+	return r.ImagesFiltered(ImagesFilterOptions{})
+}
+
+// ImagesFilterOptions controls what ImagesFiltered includes.
+type ImagesFilterOptions struct {
+	// IncludeHidden, if true, includes images marked Hidden, which
+	// Images() excludes by default.
+	IncludeHidden bool
+}
+
+// ImagesFiltered returns every known image, including images marked Hidden
+// only if opts.IncludeHidden is set.
+func (r *imageStore) ImagesFiltered(opts ImagesFilterOptions) ([]Image, error) {
+	images := make([]Image, 0, len(r.images))
+	for _, image := range r.images {
+		if image.Hidden && !opts.IncludeHidden {
+			continue
+		}
+		images = append(images, *copyImage(image))
+	}
+	return images, nil
+}
+
+// FindInvalidNames reports, per image ID, the names that valid rejects,
+// for operators checking what would break before enabling strict name
+// validation on write.  Images for which every name is valid are
+// omitted from the result.
+func (r *imageStore) FindInvalidNames(valid func(name string) bool) (map[string][]string, error) {
+	invalid := make(map[string][]string)
+	for name, image := range r.byname {
+		if !valid(name) {
+			invalid[image.ID] = append(invalid[image.ID], name)
+		}
+	}
+	return invalid, nil
+}
+
+// ImagesByRegistry returns copies of the images with at least one name
+// whose hostname portion equals host, as extracted by
+// SetRegistryHostParser's parser (or the default parser if none was
+// installed), for finding every image tagged under a registry that's
+// being decommissioned.
+func (r *imageStore) ImagesByRegistry(host string) ([]*Image, error) {
+	parse := r.registryHostParser
+	if parse == nil {
+		parse = defaultRegistryHostParser
+	}
+	var matches []*Image
+	for _, image := range r.images {
+		for _, name := range image.Names {
+			nameHost, err := parse(name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error parsing registry host from name %q", name)
+			}
+			if nameHost != "" && nameHost == host {
+				matches = append(matches, copyImage(image))
+				break
+			}
+		}
+	}
+	return matches, nil
+}
+
+// ImagesSortedBySize returns every known image ordered by the size sizeFn
+// reports for it, for "largest images" style reports, keeping the
+// layer-size dependency injected rather than hardwired here.  If
+// skipErrors is true, images for which sizeFn errors are omitted from the
+// result instead of failing the call.  Ties break by ID for a
+// deterministic order.
+func (r *imageStore) ImagesSortedBySize(sizeFn func(*Image) (int64, error), descending, skipErrors bool) ([]Image, error) {
+	type imageSize struct {
+		image *Image
+		size  int64
+	}
+	sized := make([]imageSize, 0, len(r.images))
+	for _, image := range r.images {
+		size, err := sizeFn(image)
+		if err != nil {
+			if skipErrors {
+				continue
+			}
+			return nil, errors.Wrapf(err, "error computing size of image %q", image.ID)
+		}
+		sized = append(sized, imageSize{image: image, size: size})
+	}
+	sort.Slice(sized, func(i, j int) bool {
+		if sized[i].size != sized[j].size {
+			if descending {
+				return sized[i].size > sized[j].size
+			}
+			return sized[i].size < sized[j].size
+		}
+		return sized[i].image.ID < sized[j].image.ID
+	})
+	images := make([]Image, len(sized))
+	for i, s := range sized {
+		images[i] = *copyImage(s.image)
+	}
+	return images, nil
+}
+
+func (r *imageStore) imagespath() string {
+	return filepath.Join(r.dir, "images.json")
+}
+
+// readOnlyError builds a ReadOnlyError for op against this store's path.
+func (r *imageStore) readOnlyError(op string) error {
+	return &ReadOnlyError{Op: op, Path: r.imagespath()}
+}
+
+func (r *imageStore) datadir(id string) string {
+	return filepath.Join(r.dir, id)
+}
+
+func (r *imageStore) datapath(id, key string) string {
+	return filepath.Join(r.datadir(id), makeBigDataBaseName(key))
+}
+
+// bigDataPath returns the on-disk path of an existing big data item,
+// honoring any persisted BigDataFileNames override recorded for it by
+// assignBigDataBaseName.  It never mutates image, so it's safe for read
+// paths that must still resolve items written before name hashing was
+// enabled.
+func (r *imageStore) bigDataPath(image *Image, key string) string {
+	if name, ok := image.BigDataFileNames[key]; ok {
+		return filepath.Join(r.datadir(image.ID), name)
+	}
+	return r.datapath(image.ID, key)
+}
+
+// assignBigDataBaseName returns the on-disk file name to use when writing
+// key, reusing its existing BigDataFileNames entry if it already has one.
+// Otherwise, if SetBigDataNameHashing(true) is in effect, it derives a
+// short, filesystem-safe name from the sha256 of key and records it in
+// image.BigDataFileNames so that bigDataPath can find it again; the
+// caller is responsible for saving that change along with the write it's
+// for.  With hashing disabled (the default), it falls back to
+// makeBigDataBaseName, matching pre-existing behavior.
+func (r *imageStore) assignBigDataBaseName(image *Image, key string) string {
+	if name, ok := image.BigDataFileNames[key]; ok {
+		return name
+	}
+	if !r.bigDataNameHashingEnabled {
+		return makeBigDataBaseName(key)
+	}
+	name := "sha256-" + digest.Canonical.FromString(key).Encoded()
+	if image.BigDataFileNames == nil {
+		image.BigDataFileNames = make(map[string]string)
+	}
+	image.BigDataFileNames[key] = name
+	return name
+}
+
+// normalizeNameHostname lowercases just the hostname portion of a name that
+// looks like a registry reference, leaving the repository and tag untouched.
+// Registry hostnames are case-insensitive, but repository paths and tags are
+// not, so "Docker.io/x" and "docker.io/x" should resolve to the same image
+// while "Library/x" and "library/x" must not.
+func normalizeNameHostname(name string) string {
+	idx := strings.Index(name, "/")
+	if idx <= 0 {
+		// No hostname segment to normalize (e.g. a bare "ubuntu:latest").
+		return name
+	}
+	host := name[:idx]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return strings.ToLower(host) + name[idx:]
+	}
+	return name
+}
+
+// stringSlicesEqual reports whether a and b contain the same strings in the
+// same order.
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// digestSlicesEqual reports whether a and b contain the same digests in the
+// same order.
+func digestSlicesEqual(a, b []digest.Digest) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeNames applies normalizeNameHostname to every entry, then dedupes
+// the result, since normalization can cause two previously-distinct names to
+// collapse into one.
+func normalizeNames(names []string) []string {
+	normalized := make([]string, len(names))
+	for i, name := range names {
+		normalized[i] = normalizeNameHostname(name)
+	}
+	return dedupeNames(normalized)
+}
+
+// bigDataNameIsManifest determines if a big data item with the specified name
+// is considered to be representative of the image, in that its digest can be
+// said to also be the image's digest.  Currently, if its name is, or begins
+// with, "manifest", we say that it is.
+func bigDataNameIsManifest(name string) bool {
+	return strings.HasPrefix(name, ImageDigestManifestBigDataNamePrefix)
+}
+
+// recomputeDigests takes a fixed digest and a name-to-digest map and builds a
+// list of the unique values that would identify the image.  isManifest
+// decides which big data items are treated as representative of the image;
+// pass bigDataNameIsManifest for the default prefix-based behavior.
+func (i *Image) recomputeDigests(isManifest func(name string) bool) error {
+	validDigests := make([]digest.Digest, 0, len(i.BigDataDigests)+1)
+	digests := make(map[digest.Digest]struct{})
+	if i.Digest != "" {
+		if err := i.Digest.Validate(); err != nil {
+			return errors.Wrapf(err, "error validating image digest %q", string(i.Digest))
+		}
+		digests[i.Digest] = struct{}{}
+		validDigests = append(validDigests, i.Digest)
+	}
+	for name, digest := range i.BigDataDigests {
+		if !isManifest(name) {
+			continue
+		}
+		if digest.Validate() != nil {
+			return errors.Wrapf(digest.Validate(), "error validating digest %q for big data item %q", string(digest), name)
+		}
+		// Deduplicate the digest values.
+		if _, known := digests[digest]; !known {
+			digests[digest] = struct{}{}
+			validDigests = append(validDigests, digest)
+		}
+	}
+	if i.Digest == "" && len(validDigests) > 0 {
+		i.Digest = validDigests[0]
+	}
+	i.Digests = validDigests
+	return nil
+}
+
+// computeRecordDigest returns the canonical digest of image's own JSON
+// form, with RecordDigest itself cleared first so that the field doesn't
+// try to digest itself.  See Image.RecordDigest.
+func computeRecordDigest(image *Image) (digest.Digest, error) {
+	clone := *image
+	clone.RecordDigest = ""
+	data, err := json.Marshal(&clone)
+	if err != nil {
+		return "", err
+	}
+	return digest.Canonical.FromBytes(data), nil
+}
+
+// Equal reports whether i and other describe the same image state,
+// comparing every field rather than just identity, so that a caller
+// holding a snapshot can detect whether a fresh Get result actually
+// changed without paying for a copyImage just to find out.  A nil slice
+// or map compares equal to an empty one of the same type.
+func (i *Image) Equal(other *Image) bool {
+	if i == other {
+		return true
+	}
+	if i == nil || other == nil {
+		return false
+	}
+	if i.ID != other.ID ||
+		i.Digest != other.Digest ||
+		i.TopLayer != other.TopLayer ||
+		i.Metadata != other.Metadata ||
+		i.Created != other.Created ||
+		i.ReadOnly != other.ReadOnly ||
+		i.RetentionClass != other.RetentionClass ||
+		i.Pulled != other.Pulled ||
+		i.Comment != other.Comment ||
+		i.Hidden != other.Hidden ||
+		!equalInt64Ptr(i.RootFSSize, other.RootFSSize) ||
+		i.RecordDigest != other.RecordDigest ||
+		i.ScanStatus != other.ScanStatus ||
+		!i.ExpiresAt.Equal(other.ExpiresAt) ||
+		!i.LastScanned.Equal(other.LastScanned) {
+		return false
+	}
+	if !digestSlicesEqual(i.Digests, other.Digests) {
+		return false
+	}
+	if !digestSlicesEqual(i.DiffIDs, other.DiffIDs) {
+		return false
+	}
+	if !stringSlicesEqual(i.Names, other.Names) ||
+		!stringSlicesEqual(i.NamesHistory, other.NamesHistory) ||
+		!stringSlicesEqual(i.MappedTopLayers, other.MappedTopLayers) ||
+		!stringSlicesEqual(i.BigDataNames, other.BigDataNames) {
+		return false
+	}
+	if len(i.BigDataSizes) != len(other.BigDataSizes) {
+		return false
+	}
+	for k, v := range i.BigDataSizes {
+		if other.BigDataSizes[k] != v {
+			return false
+		}
+	}
+	if len(i.BigDataDigests) != len(other.BigDataDigests) {
+		return false
+	}
+	for k, v := range i.BigDataDigests {
+		if other.BigDataDigests[k] != v {
+			return false
+		}
+	}
+	if len(i.BigDataEncryption) != len(other.BigDataEncryption) {
+		return false
+	}
+	for k, v := range i.BigDataEncryption {
+		if other.BigDataEncryption[k] != v {
+			return false
+		}
+	}
+	if len(i.BigDataFileNames) != len(other.BigDataFileNames) {
+		return false
+	}
+	for k, v := range i.BigDataFileNames {
+		if other.BigDataFileNames[k] != v {
+			return false
+		}
+	}
+	if len(i.Flags) != len(other.Flags) {
+		return false
+	}
+	for k, v := range i.Flags {
+		if !reflect.DeepEqual(other.Flags[k], v) {
+			return false
+		}
+	}
+	if len(i.Labels) != len(other.Labels) {
+		return false
+	}
+	for k, v := range i.Labels {
+		if other.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Load reads images.json from disk and replaces r.images, rebuilding every
+// in-memory index.  It records its outcome for LastLoadError before
+// returning, so a caller driving reloads in the background (ReloadIfChanged)
+// still has a way to notice a failure it didn't see synchronously.
+func (r *imageStore) Load() error {
+	err := r.load()
+	r.lastLoadErr = err
+	return err
+}
+
+func (r *imageStore) load() error {
+	// A debounced Save already reported success for whatever mutation is
+	// still only pending in memory; persist it now, before it's
+	// overwritten below by whatever load() is about to read from disk,
+	// so reloading (e.g. via ReloadIfChanged noticing another process's
+	// write, or Rollback) can't silently discard it.  Callers of load()
+	// already hold the store's write lock, same as Flush requires.
+	if err := r.flushLocked(); err != nil {
+		return err
+	}
+	// Any event queued for an in-memory mutation not yet reflected on
+	// disk is about to be discarded along with that mutation, since
+	// Load replaces r.images from images.json rather than merging.
+	r.pendingEvents = nil
+	rpath := r.imagespath()
+	data, err := ioutil.ReadFile(rpath)
+	if err != nil && !os.IsNotExist(err) {
+		return wrapFSError(err, nil)
+	}
+	images := []*Image{}
+	if err = json.Unmarshal(data, &images); len(data) != 0 && err != nil {
+		// A malformed images.json is treated as an empty store rather
+		// than a load failure; use LoadTolerant to salvage whatever of
+		// it still parses.
+		images = []*Image{}
+	}
+	shouldSave, err := r.indexParsedImages(images)
+	if err != nil {
+		return err
+	}
+	if shouldSave {
+		return r.Save()
+	}
+	return nil
+}
+
+// indexParsedImages migrates older on-disk shapes, resolves name conflicts
+// per r.duplicateNamePolicy, verifies each record's RecordDigest, and
+// rebuilds every in-memory index from images, replacing r.images on
+// success.  It reports whether any migration touched the data such that
+// the caller should Save it back.
+func (r *imageStore) indexParsedImages(images []*Image) (shouldSave bool, err error) {
+	idlist := make([]string, 0, len(images))
+	ids := make(map[string]*Image)
+	names := make(map[string]*Image)
+	digests := make(map[digest.Digest][]*Image)
+	var conflicts []DuplicateNameConflict
+	var loadConflicts []NameConflict
+	for n, image := range images {
+		ids[image.ID] = images[n]
+		idlist = append(idlist, image.ID)
+		// Migrate names written before hostname normalization was
+		// introduced, so that lookups by normalized form still find
+		// records saved by older versions of this library.
+		if normalized := normalizeNames(image.Names); !stringSlicesEqual(normalized, image.Names) {
+			image.Names = normalized
+			shouldSave = true
+		}
+		// Collapse names that normalize to the same reference (e.g.
+		// "ubuntu" and "docker.io/library/ubuntu:latest") into one
+		// canonical entry, if a normalizer has been installed.
+		if deduped, err := r.dedupeNormalizedNames(image.Names); err == nil && !stringSlicesEqual(deduped, image.Names) {
+			image.Names = deduped
+			shouldSave = true
+		}
+		for _, name := range image.Names {
+			if conflict, ok := names[name]; ok {
+				switch r.duplicateNamePolicy {
+				case DuplicateNamePolicyError:
+					return false, errors.Wrapf(ErrDuplicateImageNames, "name %q is claimed by both image %q and image %q", name, conflict.ID, image.ID)
+				case DuplicateNamePolicyReport:
+					conflicts = append(conflicts, DuplicateNameConflict{Name: name, ImageIDs: []string{conflict.ID, image.ID}})
+				default:
+					r.removeName(conflict, name)
+					loadConflicts = append(loadConflicts, NameConflict{Name: name, KeptImageID: image.ID, StrippedImageID: conflict.ID})
+					shouldSave = true
+				}
+			}
+		}
+		// Compute the digest list.
+		if err := image.recomputeDigests(r.isManifest); err != nil {
+			return false, errors.Wrapf(err, "error computing digests for image with ID %q (%v)", image.ID, image.Names)
+		}
+		for _, name := range image.Names {
+			names[name] = image
+		}
+		for _, digest := range image.Digests {
+			list := digests[digest]
+			digests[digest] = append(list, image)
+		}
+		image.ReadOnly = !r.IsReadWrite()
+	}
+	if shouldSave && (!r.IsReadWrite() || !r.Locked()) {
+		return false, ErrDuplicateImageNames
+	}
+	var tampered []string
+	for _, image := range images {
+		if image.RecordDigest == "" {
+			// Written before RecordDigest existed; nothing to verify.
+			continue
+		}
+		recordDigest, err := computeRecordDigest(image)
+		if err != nil {
+			return false, errors.Wrapf(err, "error computing record digest for image with ID %q", image.ID)
+		}
+		if recordDigest != image.RecordDigest {
+			tampered = append(tampered, image.ID)
+		}
+	}
+	r.images = images
+	if r.disableTruncIndex {
+		r.idindex = nil
+	} else {
+		r.idindex = truncindex.NewTruncIndex(idlist)
+	}
+	r.byid = ids
+	r.byname = names
+	r.bydigest = digests
+	r.tamperedRecords = tampered
+	r.duplicateNameConflicts = conflicts
+	r.loadNameConflicts = loadConflicts
+	r.invalidateCache()
+	return shouldSave, nil
+}
+
+// InvalidImageRecord describes one array element of images.json that
+// LoadTolerant could not parse into an Image, identified by its position in
+// the array and the raw JSON it failed on.
+type InvalidImageRecord struct {
+	Index int
+	Raw   jsoniter.RawMessage
+	Err   error
+}
+
+// LoadTolerant is a recovery path for a damaged images.json: rather than
+// treating the whole file as empty the way Load does when the top-level
+// unmarshal fails, it first splits the file into its raw array elements,
+// then unmarshals each into an Image on its own, skipping and reporting any
+// entry that fails instead of discarding the rest of the store.  Unlike
+// Load, it never Saves on the caller's behalf: recovering a damaged store
+// back to disk is something a caller should choose to do explicitly, after
+// inspecting the returned records, not something that happens implicitly as
+// a side effect of loading it.  A file whose array structure itself is
+// broken (as opposed to one or more elements within it) still fails outright,
+// since there's no well-defined way to split it into elements at all.
+func (r *imageStore) LoadTolerant() ([]InvalidImageRecord, error) {
+	r.pendingEvents = nil
+	rpath := r.imagespath()
+	data, err := ioutil.ReadFile(rpath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, wrapFSError(err, nil)
+	}
+	var raws []jsoniter.RawMessage
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &raws); err != nil {
+			return nil, errors.Wrapf(err, "error reading images.json array")
+		}
+	}
+	var images []*Image
+	var invalid []InvalidImageRecord
+	for index, raw := range raws {
+		var image Image
+		if err := json.Unmarshal(raw, &image); err != nil {
+			invalid = append(invalid, InvalidImageRecord{Index: index, Raw: raw, Err: err})
+			continue
+		}
+		images = append(images, &image)
+	}
+	if _, err := r.indexParsedImages(images); err != nil {
+		return invalid, err
+	}
+	return invalid, nil
+}
+
+// TamperedRecords returns the IDs of images whose on-disk record failed
+// its RecordDigest check on the most recent Load, localizing corruption
+// detection to those specific records instead of failing to load the rest
+// of the store.
+func (r *imageStore) TamperedRecords() []string {
+	return copyStringSlice(r.tamperedRecords)
+}
+
+// DuplicateNameConflicts returns the conflicting names found by the most
+// recent Load under DuplicateNamePolicyReport.
+func (r *imageStore) DuplicateNameConflicts() []DuplicateNameConflict {
+	conflicts := make([]DuplicateNameConflict, len(r.duplicateNameConflicts))
+	for i, conflict := range r.duplicateNameConflicts {
+		conflicts[i] = DuplicateNameConflict{
+			Name:     conflict.Name,
+			ImageIDs: copyStringSlice(conflict.ImageIDs),
+		}
+	}
+	return conflicts
+}
+
+// LoadConflicts returns the names the most recent Load reassigned under
+// DuplicateNamePolicyResolve.
+func (r *imageStore) LoadConflicts() []NameConflict {
+	conflicts := make([]NameConflict, len(r.loadNameConflicts))
+	copy(conflicts, r.loadNameConflicts)
+	return conflicts
+}
+
+// SetOnSaveError installs a callback invoked with the original error
+// whenever Save fails.
+func (r *imageStore) SetOnSaveError(onError func(error)) {
+	r.onSaveError = onError
+}
+
+// ImageLock returns a Locker private to the named image, backed by a lock
+// file alongside its data directory, for callers doing big-data-only work
+// that doesn't need the store-wide lock.  See the ImageStore.ImageLock
+// documentation for the scope of what it does and doesn't protect.
+func (r *imageStore) ImageLock(id string) (Locker, error) {
+	image, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	return GetLockfile(filepath.Join(r.dir, image.ID+".lock"))
+}
+
+// bigDataLock returns, creating it on first use, the per-image RWMutex
+// that guards a single image's big data file I/O against concurrent big
+// data file I/O on the same image, so a read of image B isn't serialized
+// behind a write on image A just because both run under the store's shared
+// write lock.  Every accessor that reads or writes a path returned by
+// bigDataPath (BigData, BigDataRange, BigDataReader, SetBigData,
+// SetBigDataFromReader, SetBigDataEncrypted, RenameBigData, DeleteBigData,
+// ExportBigData, ImportBigData, AdoptBigData) takes it for the duration of
+// its own file operation, so the guarantee holds across all of them, not
+// just against SetBigData specifically.  It's held only around the actual
+// file read or write, never while calling Save, so it can't deadlock
+// against the store lock Save requires.
+func (r *imageStore) bigDataLock(id string) *sync.RWMutex {
+	r.bigDataLocksMu.Lock()
+	defer r.bigDataLocksMu.Unlock()
+	if r.bigDataLocks == nil {
+		r.bigDataLocks = make(map[string]*sync.RWMutex)
+	}
+	lock, ok := r.bigDataLocks[id]
+	if !ok {
+		lock = new(sync.RWMutex)
+		r.bigDataLocks[id] = lock
+	}
+	return lock
+}
+
+// rLockedReadCloser wraps a ReadCloser so that Close also releases an
+// RWMutex read lock, keeping BigDataReader's per-image lock held only as
+// long as the caller is still reading.
+type rLockedReadCloser struct {
+	io.ReadCloser
+	unlock func()
+}
+
+func (c *rLockedReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.unlock()
+	return err
+}
+
+// BigDataReader returns an open file for a big data item, along with its
+// size from BigDataSizes (or -1 if the item predates that bookkeeping), for
+// streaming a large item instead of loading it whole via BigData.  It holds
+// the image's per-image lock (see bigDataLock) until the returned
+// ReadCloser is closed, so callers must close it promptly to avoid
+// blocking a concurrent SetBigData on the same image.  Unlike BigData, it
+// never applies a read transform installed via SetBigDataTransforms,
+// since a transform assumes it's operating on the whole item.
+func (r *imageStore) BigDataReader(id, key string) (io.ReadCloser, int64, error) {
+	if key == "" {
+		return nil, -1, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve image big data value for empty name")
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return nil, -1, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	size, ok := image.BigDataSizes[key]
+	if !ok {
+		size = -1
+	}
+	lock := r.bigDataLock(image.ID)
+	lock.RLock()
+	f, err := os.Open(r.bigDataPath(image, key))
+	if err != nil {
+		lock.RUnlock()
+		return nil, -1, wrapFSError(err, ErrBigDataUnknown)
+	}
+	return &rLockedReadCloser{ReadCloser: f, unlock: lock.RUnlock}, size, nil
+}
+
+// SetNameNormalizer installs a function mapping a name to the canonical
+// form of the reference it identifies, for collapsing equivalent names.
+func (r *imageStore) SetNameNormalizer(normalize func(name string) (string, error)) {
+	r.nameNormalizer = normalize
+}
+
+// SetRegistryHostParser installs a function extracting the hostname
+// portion of a name reference, for ImagesByRegistry.  Pass nil to restore
+// the default parser.
+func (r *imageStore) SetRegistryHostParser(parse func(name string) (string, error)) {
+	r.registryHostParser = parse
+}
+
+// defaultRegistryHostParser extracts the segment of name before the first
+// "/" when it looks like a hostname, matching normalizeNameHostname's
+// notion of a hostname segment.  It returns "" if name has no such
+// segment.
+func defaultRegistryHostParser(name string) (string, error) {
+	idx := strings.Index(name, "/")
+	if idx <= 0 {
+		return "", nil
+	}
+	host := name[:idx]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host, nil
+	}
+	return "", nil
+}
+
+func (r *imageStore) Save() error {
+	if r.inTransaction {
+		// Defer persisting until Commit(); the in-memory state already
+		// reflects the change, and Rollback() can still discard it by
+		// reloading from the copy on disk, which hasn't been touched.
+		return nil
+	}
+	if r.saveDebounce > 0 {
+		r.deferSave()
+		return nil
+	}
+	err := r.save()
+	if err != nil && r.onSaveError != nil {
+		r.onSaveError(err)
+	}
+	return err
+}
+
+// SetSaveDebounce configures Save to defer persisting to a background
+// timer that flushes at most once per debounce, instead of writing on
+// every call.  Pass 0 to disable it (the default).
+func (r *imageStore) SetSaveDebounce(debounce time.Duration) {
+	r.saveDebounce = debounce
+}
+
+// deferSave marks the store dirty and, if no flush is already scheduled,
+// starts a timer to flush after the configured debounce.
+func (r *imageStore) deferSave() {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.saveDirty = true
+	if r.saveTimer == nil {
+		r.saveTimer = time.AfterFunc(r.saveDebounce, r.flushDebounced)
+	}
+}
+
+// flushDebounced is the background timer callback for a debounced Save.
+func (r *imageStore) flushDebounced() {
+	if err := r.Flush(); err != nil && r.onSaveError != nil {
+		r.onSaveError(err)
+	}
+}
+
+// Flush immediately persists any mutation still pending from a debounced
+// Save, taking the store lock for the duration of the write so that
+// cross-process readers never observe a partial flush, and never see the
+// pending in-memory state treated as committed until this returns
+// successfully.  It's a no-op if nothing is pending.
+func (r *imageStore) Flush() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.flushLocked()
+}
+
+// flushLocked is Flush's implementation for a caller that already holds
+// the store's write lock: load() calls it before replacing r.images with
+// whatever is on disk, so a mutation a debounced Save already reported as
+// successful gets persisted first instead of being silently discarded by
+// the reload.  It's a no-op if nothing is pending.
+func (r *imageStore) flushLocked() error {
+	r.saveMu.Lock()
+	if !r.saveDirty {
+		r.saveMu.Unlock()
+		return nil
+	}
+	r.saveDirty = false
+	if r.saveTimer != nil {
+		r.saveTimer.Stop()
+		r.saveTimer = nil
+	}
+	r.saveMu.Unlock()
+
+	err := r.save()
+	if err != nil && r.onSaveError != nil {
+		r.onSaveError(err)
+	}
+	return err
+}
+
+func (r *imageStore) save() error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the image store at %q", r.imagespath())
+	}
+	if !r.Locked() {
+		return errors.New("image store is not locked for writing")
+	}
+	rpath := r.imagespath()
+	if err := os.MkdirAll(filepath.Dir(rpath), 0700); err != nil {
+		return wrapFSError(err, nil)
+	}
+	for _, image := range r.images {
+		recordDigest, err := computeRecordDigest(image)
+		if err != nil {
+			return errors.Wrapf(err, "error computing record digest for image with ID %q", image.ID)
+		}
+		image.RecordDigest = recordDigest
+	}
+	start := time.Now()
+	if err := r.rotateBackups(); err != nil {
+		return err
+	}
+	defer r.Touch()
+	size, err := r.atomicWriteJSON(rpath, &r.images, 0600)
+	if err != nil {
+		return wrapFSError(err, nil)
+	}
+	r.lastSaveSize = size
+	r.lastSaveDuration = time.Since(start)
+	r.publishPendingEvents()
+	return nil
+}
+
+// rotateBackups, if KeepBackups is configured, renames the current
+// images.json to images.json.1, after first shifting images.json.1 through
+// images.json.(keepBackups-1) up by one and discarding whatever was at
+// images.json.keepBackups, so the Save about to happen doesn't clobber the
+// last known-good copy.  Each rename is atomic, and a missing source file at
+// any step is not an error, so a crash mid-rotation just leaves a shorter
+// chain rather than a gap.
+func (r *imageStore) rotateBackups() error {
+	if r.keepBackups <= 0 {
+		return nil
+	}
+	rpath := r.imagespath()
+	if err := os.Remove(fmt.Sprintf("%s.%d", rpath, r.keepBackups)); err != nil && !os.IsNotExist(err) {
+		return wrapFSError(err, nil)
+	}
+	for n := r.keepBackups; n > 1; n-- {
+		from := fmt.Sprintf("%s.%d", rpath, n-1)
+		to := fmt.Sprintf("%s.%d", rpath, n)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return wrapFSError(err, nil)
+		}
+	}
+	if err := os.Rename(rpath, rpath+".1"); err != nil && !os.IsNotExist(err) {
+		return wrapFSError(err, nil)
+	}
+	return nil
+}
+
+// LastSaveSize returns the size in bytes of images.json as of the most
+// recent successful Save, or 0 if Save has never succeeded.
+func (r *imageStore) LastSaveSize() int64 {
+	return r.lastSaveSize
+}
+
+// LastSaveDuration returns how long the most recent successful Save took
+// to marshal and write images.json, or 0 if Save has never succeeded.
+func (r *imageStore) LastSaveDuration() time.Duration {
+	return r.lastSaveDuration
+}
+
+func newImageStore(dir string) (ImageStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lockfile, err := GetLockfile(filepath.Join(dir, "images.lock"))
+	if err != nil {
+		return nil, err
+	}
+	lockfile.Lock()
+	defer lockfile.Unlock()
+	istore := imageStore{
+		lockfile: lockfile,
+		dir:      dir,
+		images:   []*Image{},
+		byid:     make(map[string]*Image),
+		byname:   make(map[string]*Image),
+		bydigest: make(map[digest.Digest][]*Image),
+	}
+	if err := istore.Load(); err != nil {
+		return nil, err
+	}
+	return &istore, nil
+}
+
+func newROImageStore(dir string) (ROImageStore, error) {
+	lockfile, err := GetROLockfile(filepath.Join(dir, "images.lock"))
+	if err != nil {
+		return nil, err
+	}
+	lockfile.RLock()
+	defer lockfile.Unlock()
+	istore := imageStore{
+		lockfile: lockfile,
+		dir:      dir,
+		images:   []*Image{},
+		byid:     make(map[string]*Image),
+		byname:   make(map[string]*Image),
+		bydigest: make(map[digest.Digest][]*Image),
+	}
+	if err := istore.Load(); err != nil {
+		return nil, err
+	}
+	return &istore, nil
+}
+
+func (r *imageStore) lookup(id string) (*Image, bool) {
+	if image, ok := r.byid[id]; ok {
+		return image, ok
+	} else if image, ok := r.byname[id]; ok {
+		return image, ok
+	} else if image, ok := r.byname[normalizeNameHostname(id)]; ok {
+		return image, ok
+	} else if r.defaultTagEnabled && !hasTagOrDigest(id) {
+		if image, ok := r.byname[id+":latest"]; ok {
+			return image, ok
+		}
+	}
+	if r.idindex != nil {
+		if longid, err := r.idindex.Get(id); err == nil {
+			image, ok := r.byid[longid]
+			return image, ok
+		}
+	}
+	return nil, false
+}
+
+// hasTagOrDigest reports whether name's final path segment already carries
+// an explicit tag or digest, so that default-tag lookup doesn't append
+// ":latest" to something that doesn't need it.
+func hasTagOrDigest(name string) bool {
+	if strings.Contains(name, "@") {
+		return true
+	}
+	segment := name
+	if i := strings.LastIndex(segment, "/"); i != -1 {
+		segment = segment[i+1:]
+	}
+	return strings.Contains(segment, ":")
+}
+
+func (r *imageStore) ClearFlag(id string, flag string) error {
+	if !r.IsReadWrite() {
+		return r.readOnlyError("clear flags on images")
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	delete(image.Flags, flag)
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+func (r *imageStore) SetFlag(id string, flag string, value interface{}) error {
+	if !r.IsReadWrite() {
+		return r.readOnlyError("set flags on images")
+	}
+	if _, reserved := ReservedFlagKeys[flag]; reserved {
+		return errors.Errorf("flag key %q is reserved", flag)
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if image.Flags == nil {
+		image.Flags = make(map[string]interface{})
+	}
+	image.Flags[flag] = value
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+func (r *imageStore) Create(id string, names []string, layer, metadata string, created time.Time, searchableDigest digest.Digest) (image *Image, err error) {
+	if !r.IsReadWrite() {
+		return nil, r.readOnlyError("create new images")
+	}
+	if id == "" {
+		id = stringid.GenerateRandomID()
+		_, idInUse := r.byid[id]
+		for idInUse {
+			id = stringid.GenerateRandomID()
+			_, idInUse = r.byid[id]
+		}
+	}
+	if _, idInUse := r.byid[id]; idInUse {
+		return nil, errors.Wrapf(ErrDuplicateID, "an image with ID %q already exists", id)
+	}
+	names = normalizeNames(names)
+	names, err = r.dedupeNormalizedNames(names)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if image, nameInUse := r.byname[name]; nameInUse {
+			return nil, errors.Wrapf(ErrDuplicateName, "image name %q is already associated with image %q", name, image.ID)
+		}
+	}
+	if created.IsZero() {
+		created = time.Now().UTC()
+	}
+	if err == nil {
+		image = &Image{
+			ID:             id,
+			Digest:         searchableDigest,
+			Digests:        nil,
+			Names:          names,
+			TopLayer:       layer,
+			Metadata:       metadata,
+			BigDataNames:   []string{},
+			BigDataSizes:   make(map[string]int64),
+			BigDataDigests: make(map[string]digest.Digest),
+			Created:        created,
+			Flags:          make(map[string]interface{}),
+			RootFSSize:     nil,
+		}
+		err := image.recomputeDigests(r.isManifest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error validating digests for new image")
+		}
+		r.images = append(r.images, image)
+		if r.idindex != nil {
+			r.idindex.Add(id)
+		}
+		r.byid[id] = image
+		for _, name := range names {
+			r.byname[name] = image
+		}
+		for _, digest := range image.Digests {
+			list := r.bydigest[digest]
+			r.bydigest[digest] = append(list, image)
+		}
+		r.bumpGenerationAs(image.ID, ImageEventCreated)
+		err = r.Save()
+		image = copyImage(image)
+	}
+	return image, err
+}
+
+// CreateComplete is like Create, but also writes every item in
+// opts.BigData and assigns opts.Names under the same Save as the new
+// record, so that pull-style sequences of Create, SetBigData, and
+// SetNames never leave a window where another process observes the image
+// without its manifest or names.
+func (r *imageStore) CreateComplete(opts CreateOptions) (*Image, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new images at %q", r.imagespath())
+	}
+	id := opts.ID
+	if id == "" {
+		id = stringid.GenerateRandomID()
+		_, idInUse := r.byid[id]
+		for idInUse {
+			id = stringid.GenerateRandomID()
+			_, idInUse = r.byid[id]
+		}
+	}
+	if _, idInUse := r.byid[id]; idInUse {
+		return nil, errors.Wrapf(ErrDuplicateID, "an image with ID %q already exists", id)
+	}
+	names, err := r.dedupeNormalizedNames(normalizeNames(opts.Names))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if image, nameInUse := r.byname[name]; nameInUse {
+			return nil, errors.Wrapf(ErrDuplicateName, "image name %q is already associated with image %q", name, image.ID)
+		}
+	}
+	created := opts.Created
+	if created.IsZero() {
+		created = time.Now().UTC()
+	}
+	image := &Image{
+		ID:             id,
+		Digest:         opts.SearchableDigest,
+		Names:          names,
+		TopLayer:       opts.Layer,
+		Metadata:       opts.Metadata,
+		BigDataNames:   []string{},
+		BigDataSizes:   make(map[string]int64),
+		BigDataDigests: make(map[string]digest.Digest),
+		Created:        created,
+		Flags:          make(map[string]interface{}),
+		RootFSSize:     nil,
+	}
+	if len(opts.BigData) > 0 {
+		if err := os.MkdirAll(r.datadir(id), 0700); err != nil {
+			return nil, wrapFSError(err, nil)
+		}
+	}
+	for key, data := range opts.BigData {
+		if key == "" {
+			return nil, errors.Wrapf(ErrInvalidBigDataName, "can't set empty name for image big data item")
+		}
+		if r.minFreeBytes > 0 {
+			free, ok, err := system.FreeSpace(r.datadir(id))
+			if err != nil {
+				return nil, errors.Wrapf(err, "error checking free space before writing big data item %q", key)
+			}
+			if ok && free < r.minFreeBytes {
+				return nil, errors.Wrapf(ErrInsufficientSpace, "only %d bytes free, need at least %d", free, r.minFreeBytes)
+			}
+		}
+		if r.bigDataWriteTransform != nil {
+			if data, err = r.bigDataWriteTransform(key, data); err != nil {
+				return nil, errors.Wrapf(err, "error transforming big data item %q for write", key)
+			}
+		}
+		var itemDigest digest.Digest
+		if r.isManifest(key) {
+			if opts.DigestManifest == nil {
+				return nil, errors.Wrapf(ErrDigestUnknown, "error digesting manifest: no manifest digest callback provided")
+			}
+			if itemDigest, err = opts.DigestManifest(data); err != nil {
+				return nil, errors.Wrapf(err, "error digesting manifest")
+			}
+		} else {
+			itemDigest = digest.Canonical.FromBytes(data)
+		}
+		if err := wrapFSError(r.atomicWriteFile(filepath.Join(r.datadir(id), r.assignBigDataBaseName(image, key)), data, 0600), nil); err != nil {
+			return nil, err
+		}
+		image.BigDataNames = append(image.BigDataNames, key)
+		image.BigDataSizes[key] = int64(len(data))
+		image.BigDataDigests[key] = itemDigest
+	}
+	if err := image.recomputeDigests(r.isManifest); err != nil {
+		return nil, errors.Wrapf(err, "error validating digests for new image")
+	}
+	r.images = append(r.images, image)
+	if r.idindex != nil {
+		r.idindex.Add(id)
+	}
+	r.byid[id] = image
+	for _, name := range names {
+		r.byname[name] = image
+	}
+	for _, imageDigest := range image.Digests {
+		list := r.bydigest[imageDigest]
+		r.bydigest[imageDigest] = append(list, image)
+	}
+	r.bumpGenerationAs(image.ID, ImageEventCreated)
+	if err := r.Save(); err != nil {
+		return nil, err
+	}
+	return copyImage(image), nil
+}
+
+func (r *imageStore) addMappedTopLayer(id, layer string) error {
+	if image, ok := r.lookup(id); ok {
+		image.MappedTopLayers = append(image.MappedTopLayers, layer)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (r *imageStore) removeMappedTopLayer(id, layer string) error {
+	if image, ok := r.lookup(id); ok {
+		initialLen := len(image.MappedTopLayers)
+		image.MappedTopLayers = stringutils.RemoveFromSlice(image.MappedTopLayers, layer)
+		// No layer was removed.  No need to save.
+		if initialLen == len(image.MappedTopLayers) {
+			return nil
+		}
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (r *imageStore) Metadata(id string) (string, error) {
+	if image, ok := r.lookup(id); ok {
+		return image.Metadata, nil
+	}
+	return "", errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (r *imageStore) SetMetadata(id, metadata string) error {
+	if !r.IsReadWrite() {
+		return r.readOnlyError("modify image metadata")
+	}
+	if image, ok := r.lookup(id); ok {
+		image.Metadata = metadata
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (r *imageStore) SetRetentionClass(id, class string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image retention class at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		image.RetentionClass = class
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (r *imageStore) SetPulled(id string, pulled time.Time) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image pulled time at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		image.Pulled = pulled
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// ClampCreated sets an image's Created to to, for correcting a record
+// surfaced by ImagesWithFutureCreated whose build timestamp was bogus.
+func (r *imageStore) ClampCreated(id string, to time.Time) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image created time at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	image.Created = to
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// SetExpiry sets or, if expiresAt is the zero time, clears an image's
+// ExpiresAt, controlling its eligibility for PruneExpired.
+func (r *imageStore) SetExpiry(id string, expiresAt time.Time) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image expiry at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		image.ExpiresAt = expiresAt
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// SetMetadataCAS compares-and-swaps an image's Metadata: it writes newValue
+// only if the image's current Metadata equals oldValue, and reports whether
+// the swap happened.  This prevents lost updates when two processes edit the
+// same image's metadata concurrently, mirroring the CAS semantics proposed
+// for flags.
+func (r *imageStore) SetMetadataCAS(id, oldValue, newValue string) (bool, error) {
+	if !r.IsReadWrite() {
+		return false, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image metadata at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return false, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if image.Metadata != oldValue {
+		return false, nil
+	}
+	image.Metadata = newValue
+	r.bumpGeneration(image.ID)
+	if err := r.Save(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetComment sets an image's free-text Comment field, distinct from
+// Metadata, which callers treat as structured.
+func (r *imageStore) SetComment(id, comment string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image comment at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		image.Comment = comment
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// SetRootFSSize sets the cached uncompressed layer size for an image, which
+// may legitimately be 0 (e.g. a scratch-based image). Pass -1 to mark it
+// unknown again.
+func (r *imageStore) SetRootFSSize(id string, size int64) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image rootfs size at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		if size < 0 {
+			image.RootFSSize = nil
+		} else {
+			image.RootFSSize = &size
+		}
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// SetDiffIDs caches diffIDs, the ordered list of layer diff IDs making up
+// the image's layer stack, so that ByDiffID can find images sharing a layer
+// by content without consulting the layer store. Pass nil to clear it.
+func (r *imageStore) SetDiffIDs(id string, diffIDs []digest.Digest) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image diff IDs at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		image.DiffIDs = copyDigestSlice(diffIDs)
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// ByDiffID returns copies of every image whose DiffIDs includes d, for
+// callers that want to find images sharing a layer by content using only
+// cached image metadata, without consulting the layer store.
+func (r *imageStore) ByDiffID(d digest.Digest) ([]*Image, error) {
+	var matches []*Image
+	for _, image := range r.images {
+		for _, diffID := range image.DiffIDs {
+			if diffID == d {
+				matches = append(matches, copyImage(image))
+				break
+			}
+		}
+	}
+	return matches, nil
+}
+
+// SetScanStatus records that a security scanner examined this image at
+// scanned, with result status, so that ImagesNeedingScan can find images
+// that are unscanned or overdue for a rescan.  The store doesn't interpret
+// status; that's the caller's responsibility.
+func (r *imageStore) SetScanStatus(id string, scanned time.Time, status string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image scan status at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		image.LastScanned = scanned
+		image.ScanStatus = status
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// SetLabel sets key to value in the image's Labels map, creating the map if
+// it's nil.
+func (r *imageStore) SetLabel(id, key, value string) error {
+	if !r.IsReadWrite() {
+		return r.readOnlyError("modify image labels")
+	}
+	if image, ok := r.lookup(id); ok {
+		if image.Labels == nil {
+			image.Labels = make(map[string]string)
+		}
+		image.Labels[key] = value
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// RemoveLabel deletes key from the image's Labels map, if present.
+func (r *imageStore) RemoveLabel(id, key string) error {
+	if !r.IsReadWrite() {
+		return r.readOnlyError("modify image labels")
+	}
+	if image, ok := r.lookup(id); ok {
+		delete(image.Labels, key)
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// Labels returns a copy of the image's Labels map, which may be nil if none
+// have been set.
+func (r *imageStore) Labels(id string) (map[string]string, error) {
+	if image, ok := r.lookup(id); ok {
+		return copyStringStringMap(image.Labels), nil
+	}
+	return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// ImagesNeedingScan returns copies of every image whose ScanStatus is
+// unset, or whose LastScanned is more than staleAfter in the past, for
+// scheduling tools that want to find unscanned or stale-scanned images. A
+// zero staleAfter matches any image that has ever been scanned.
+func (r *imageStore) ImagesNeedingScan(staleAfter time.Duration) ([]*Image, error) {
+	var needsScan []*Image
+	cutoff := time.Now().Add(-staleAfter)
+	for _, image := range r.images {
+		if image.ScanStatus == "" || image.LastScanned.Before(cutoff) {
+			needsScan = append(needsScan, copyImage(image))
+		}
+	}
+	return needsScan, nil
+}
+
+// BackfillBigDataSizes stats every item in the image's BigDataNames that's
+// missing from BigDataSizes and records its on-disk size, saving once if it
+// found anything to fill in.
+// DataDirUsage walks id's datadir, including subdirectories, and sums the
+// actual on-disk size of every regular file it finds, for the true
+// on-disk footprint of an image's big data, as opposed to the logical
+// content sizes recorded in BigDataSizes.
+func (r *imageStore) DataDirUsage(id string) (int64, error) {
+	image, ok := r.lookup(id)
+	if !ok {
+		return 0, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	var usage int64
+	err := filepath.Walk(r.datadir(image.ID), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			usage += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, wrapFSError(err, nil)
+	}
+	return usage, nil
+}
+
+func (r *imageStore) BackfillBigDataSizes(id string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image big data sizes at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	save := false
+	for _, key := range image.BigDataNames {
+		if _, ok := image.BigDataSizes[key]; ok {
+			continue
+		}
+		info, err := os.Stat(r.bigDataPath(image, key))
+		if err != nil {
+			continue
+		}
+		if image.BigDataSizes == nil {
+			image.BigDataSizes = make(map[string]int64)
+		}
+		image.BigDataSizes[key] = info.Size()
+		save = true
+	}
+	if !save {
+		return nil
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// RebuildFromDataDirs is a disaster-recovery repair pass for stores whose
+// images.json survived but lost its BigDataDigests (and possibly
+// BigDataSizes): for every image, it re-reads each item named in
+// BigDataNames from disk, recomputes its size and digest (using
+// digestManifest for items isManifest considers manifests), rebuilds the
+// digest-based index from the results, and Saves once. It returns an
+// error immediately if digestManifest is nil and a manifest item is
+// found; a missing data file for a key is skipped rather than treated as
+// fatal, since the point is to recover what's still present.
+func (r *imageStore) RebuildFromDataDirs(digestManifest func([]byte) (digest.Digest, error)) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to rebuild image digests at %q", r.imagespath())
+	}
+	for _, image := range r.images {
+		if image.BigDataSizes == nil {
+			image.BigDataSizes = make(map[string]int64)
+		}
+		if image.BigDataDigests == nil {
+			image.BigDataDigests = make(map[string]digest.Digest)
+		}
+		for _, key := range image.BigDataNames {
+			data, err := ioutil.ReadFile(r.bigDataPath(image, key))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return errors.Wrapf(err, "error reading big data item %q for image %q", key, image.ID)
+			}
+			if r.bigDataReadTransform != nil {
+				if data, err = r.bigDataReadTransform(key, data); err != nil {
+					return errors.Wrapf(err, "error transforming big data item %q for image %q", key, image.ID)
+				}
+			}
+			var itemDigest digest.Digest
+			if r.isManifest(key) {
+				if digestManifest == nil {
+					return errors.Wrapf(ErrDigestUnknown, "error digesting manifest %q for image %q: no manifest digest callback provided", key, image.ID)
+				}
+				if itemDigest, err = digestManifest(data); err != nil {
+					return errors.Wrapf(err, "error digesting manifest %q for image %q", key, image.ID)
+				}
+			} else {
+				itemDigest = digest.Canonical.FromBytes(data)
+			}
+			image.BigDataSizes[key] = int64(len(data))
+			image.BigDataDigests[key] = itemDigest
+		}
+		if err := image.recomputeDigests(r.isManifest); err != nil {
+			return errors.Wrapf(err, "error recomputing digests for image %q", image.ID)
+		}
+	}
+	bydigest := make(map[digest.Digest][]*Image)
+	for _, image := range r.images {
+		for _, d := range image.Digests {
+			bydigest[d] = append(bydigest[d], image)
+		}
+	}
+	r.bydigest = bydigest
+	for _, image := range r.images {
+		r.bumpGeneration(image.ID)
+	}
+	return r.Save()
+}
+
+// BackfillAllBigDataSizes calls BackfillBigDataSizes for every image, for
+// use as a one-time repair pass after upgrading a store that predates
+// BigDataSizes.
+func (r *imageStore) BackfillAllBigDataSizes() error {
+	var result *multierror.Error
+	for _, image := range r.images {
+		if err := r.BackfillBigDataSizes(image.ID); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// SetDefaultTagLookup controls whether lookup by a bare name that doesn't
+// directly resolve also tries appending ":latest" before giving up.
+func (r *imageStore) SetDefaultTagLookup(enabled bool) {
+	r.defaultTagEnabled = enabled
+}
+
+// SetFlags merges flags into an image's Flags in a single Save, rejecting
+// any key in ReservedFlagKeys.
+func (r *imageStore) SetFlags(id string, flags map[string]interface{}) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to set flags on images at %q", r.imagespath())
+	}
+	for flag := range flags {
+		if _, reserved := ReservedFlagKeys[flag]; reserved {
+			return errors.Errorf("flag key %q is reserved", flag)
+		}
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if image.Flags == nil {
+		image.Flags = make(map[string]interface{})
+	}
+	for flag, value := range flags {
+		image.Flags[flag] = value
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// ClearFlags removes several keys from an image's Flags in a single Save.
+func (r *imageStore) ClearFlags(id string, keys []string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to clear flags on images at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	for _, key := range keys {
+		delete(image.Flags, key)
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// SetHidden marks or unmarks an image as excluded from Images() by default.
+func (r *imageStore) SetHidden(id string, hidden bool) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image visibility at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		image.Hidden = hidden
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (r *imageStore) removeName(image *Image, name string) {
+	image.Names = stringSliceWithoutValue(image.Names, name)
+}
+
+// addNameToHistory prepends name to image.NamesHistory, dedupes, and then,
+// if r.maxNamesHistory is positive, truncates to that many entries so the
+// oldest names fall off the end.
+func (r *imageStore) addNameToHistory(image *Image, name string) {
+	history := dedupeNames(append([]string{name}, image.NamesHistory...))
+	if r.maxNamesHistory > 0 && len(history) > r.maxNamesHistory {
+		history = history[:r.maxNamesHistory]
+	}
+	image.NamesHistory = history
+}
+
+// setNames applies the name-conflict and history semantics shared by
+// SetNames and SetNamesAndMetadata to image, without saving.
+func (r *imageStore) setNames(image *Image, names []string) error {
+	names = normalizeNames(names)
+	names, err := r.dedupeNormalizedNames(names)
+	if err != nil {
+		return err
+	}
+	for _, name := range image.Names {
+		delete(r.byname, name)
+	}
+	for _, name := range names {
+		if otherImage, ok := r.byname[name]; ok {
+			r.removeName(otherImage, name)
+		}
+		r.byname[name] = image
+		r.addNameToHistory(image, name)
+	}
+	image.Names = names
+	return nil
+}
+
+func (r *imageStore) SetNames(id string, names []string) error {
+	if !r.IsReadWrite() {
+		return r.readOnlyError("change image name assignments")
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if err := r.setNames(image, names); err != nil {
+		return err
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// SetNamesExclusive is like SetNames, but refuses to reassign a name that
+// currently belongs to a different image instead of stealing it the way
+// setNames (and so SetNames) does: it dedupes names, checks all of them
+// against r.byname up front, and fails with ErrDuplicateName identifying
+// the conflicting image before making any change, so a rejected call never
+// partially applies.
+func (r *imageStore) SetNamesExclusive(id string, names []string) error {
+	if !r.IsReadWrite() {
+		return r.readOnlyError("change image name assignments")
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	names = normalizeNames(names)
+	names, err := r.dedupeNormalizedNames(names)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if otherImage, ok := r.byname[name]; ok && otherImage.ID != image.ID {
+			return errors.Wrapf(ErrDuplicateName, "image name %q is already associated with image %q", name, otherImage.ID)
+		}
+	}
+	for _, name := range image.Names {
+		delete(r.byname, name)
+	}
+	for _, name := range names {
+		r.byname[name] = image
+		r.addNameToHistory(image, name)
+	}
+	image.Names = names
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// SetNamesAndMetadata applies SetNames and SetMetadata as a single
+// operation under one Save, for callers like `podman commit` that set both
+// together and want no on-disk state where one has taken effect but not
+// the other.
+func (r *imageStore) SetNamesAndMetadata(id string, names []string, metadata string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to change image name assignments at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if err := r.setNames(image, names); err != nil {
+		return err
+	}
+	image.Metadata = metadata
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// MoveName assigns name to toImageID, stealing it away from whichever
+// image currently holds it, if any, and reports that image's ID so the
+// caller doesn't have to look it up separately, matching `docker tag`'s
+// move-not-copy semantics for a name reassignment.  Unlike SetNames, it
+// only touches the one name; toImageID's other names are left alone.
+func (r *imageStore) MoveName(name, toImageID string) (fromImageID string, err error) {
+	if !r.IsReadWrite() {
+		return "", errors.Wrapf(ErrStoreIsReadOnly, "not allowed to change image name assignments at %q", r.imagespath())
+	}
+	toImage, ok := r.lookup(toImageID)
+	if !ok {
+		return "", errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", toImageID)
+	}
+	normalized := normalizeNames([]string{name})
+	if len(normalized) != 1 {
+		return "", errors.Errorf("error normalizing name %q", name)
+	}
+	name = normalized[0]
+
+	if fromImage, ok := r.byname[name]; ok {
+		if fromImage.ID == toImage.ID {
+			return "", nil
+		}
+		fromImageID = fromImage.ID
+		r.removeName(fromImage, name)
+	}
+	r.byname[name] = toImage
+	toImage.Names = dedupeNames(append(toImage.Names, name))
+	r.addNameToHistory(toImage, name)
+	r.bumpGeneration(toImage.ID)
+	if err := r.Save(); err != nil {
+		return "", err
+	}
+	return fromImageID, nil
+}
+
+// ReplaceContent overwrites image's TopLayer, big data items, and Metadata
+// in place, leaving its ID and Names/NamesHistory untouched, to model an
+// in-place rebuild such as a repeated `podman build` of the same tag. Big
+// data items that existed before the call but aren't present in bigData are
+// removed from disk and from the index; the rest are written or overwritten
+// and the image's digests are recomputed from the result before the whole
+// change is saved atomically.
+func (r *imageStore) ReplaceContent(id string, layer string, bigData map[string][]byte, metadata string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to replace image content at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if err := os.MkdirAll(r.datadir(image.ID), 0700); err != nil {
+		return wrapFSError(err, nil)
+	}
+	for _, oldDigest := range image.Digests {
+		if list, ok := r.bydigest[oldDigest]; ok {
+			prunedList := imageSliceWithoutValue(list, image)
+			if len(prunedList) == 0 {
+				delete(r.bydigest, oldDigest)
+			} else {
+				r.bydigest[oldDigest] = prunedList
+			}
+		}
+	}
+	for _, oldKey := range image.BigDataNames {
+		if _, keep := bigData[oldKey]; keep {
+			continue
+		}
+		if err := os.Remove(r.bigDataPath(image, oldKey)); err != nil && !os.IsNotExist(err) {
+			return wrapFSError(err, nil)
+		}
+		delete(image.BigDataSizes, oldKey)
+		delete(image.BigDataDigests, oldKey)
+		delete(image.BigDataFileNames, oldKey)
+	}
+	newNames := make([]string, 0, len(bigData))
+	for key, data := range bigData {
+		if key == "" {
+			return errors.Wrapf(ErrInvalidBigDataName, "can't set empty name for image big data item")
+		}
+		if err := wrapFSError(r.atomicWriteFile(filepath.Join(r.datadir(image.ID), r.assignBigDataBaseName(image, key)), data, 0600), nil); err != nil {
+			return err
+		}
+		if image.BigDataSizes == nil {
+			image.BigDataSizes = make(map[string]int64)
+		}
+		image.BigDataSizes[key] = int64(len(data))
+		if image.BigDataDigests == nil {
+			image.BigDataDigests = make(map[string]digest.Digest)
+		}
+		image.BigDataDigests[key] = digest.Canonical.FromBytes(data)
+		newNames = append(newNames, key)
+	}
+	image.BigDataNames = newNames
+	image.TopLayer = layer
+	image.Metadata = metadata
+	if err := image.recomputeDigests(r.isManifest); err != nil {
+		return errors.Wrapf(err, "error recomputing digests for image %s", image.ID)
+	}
+	for _, newDigest := range image.Digests {
+		list := r.bydigest[newDigest]
+		if len(list) == len(imageSliceWithoutValue(list, image)) {
+			r.bydigest[newDigest] = append(list, image)
+		}
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+func (r *imageStore) Delete(id string) error {
+	if !r.IsReadWrite() {
+		return r.readOnlyError("delete images")
+	}
+	id, err := r.deleteImage(id)
+	if err != nil {
+		return err
+	}
+	if err := r.Save(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(r.datadir(id)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// deleteImage removes id's record from every in-memory index and from
+// r.images, without Saving or touching its on-disk data directory, so that
+// callers deleting several images at once can defer both to the end of the
+// batch.  It returns the image's canonical ID.
+func (r *imageStore) deleteImage(id string) (string, error) {
+	image, ok := r.lookup(id)
+	if !ok {
+		return "", errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	id = image.ID
+	toDeleteIndex := -1
+	for i, candidate := range r.images {
+		if candidate.ID == id {
+			toDeleteIndex = i
+		}
+	}
+	delete(r.byid, id)
+	if r.idindex != nil {
+		r.idindex.Delete(id)
+	}
+	for _, name := range image.Names {
+		delete(r.byname, name)
+	}
+	for _, digest := range image.Digests {
+		prunedList := imageSliceWithoutValue(r.bydigest[digest], image)
+		if len(prunedList) == 0 {
+			delete(r.bydigest, digest)
+		} else {
+			r.bydigest[digest] = prunedList
+		}
+	}
+	if toDeleteIndex != -1 {
+		// delete the image at toDeleteIndex
+		if toDeleteIndex == len(r.images)-1 {
+			r.images = r.images[:len(r.images)-1]
+		} else {
+			r.images = append(r.images[:toDeleteIndex], r.images[toDeleteIndex+1:]...)
+		}
+	}
+	r.invalidateCache()
+	r.queueEvent(ImageEventRemoved, id)
+	return id, nil
+}
+
+// DeleteOptions controls the protections DeleteMany enforces across the
+// batch it's asked to remove.
+type DeleteOptions struct {
+	// RequireUntagged causes DeleteMany to refuse to delete any image in
+	// the batch that still has one or more Names, instead of deleting
+	// the rest of the batch around it.
+	RequireUntagged bool
+}
+
+// DeleteMany removes the images named by ids.  Ids that don't resolve to an
+// image, or that opts or a pinned/read-only flag protects, are skipped and
+// reported in the returned error instead of aborting the batch.  The rest
+// are ordered with DeletionOrder, so that mapped layers go before the
+// canonical top layer they were derived from, deleted, and Saved once,
+// instead of once per image; only then are their data directories removed.
+// See the DeleteMany doc on the ImageStore interface for the atomicity
+// implications of that split. It returns the IDs it actually deleted.
+func (r *imageStore) DeleteMany(ids []string, opts DeleteOptions) ([]string, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete images at %q", r.imagespath())
+	}
+	var result *multierror.Error
+	resolved := make([]string, 0, len(ids))
+	for _, id := range ids {
+		image, ok := r.lookup(id)
+		if !ok {
+			result = multierror.Append(result, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id))
+			continue
+		}
+		if image.ReadOnly {
+			result = multierror.Append(result, errors.Errorf("image %q is read-only", image.ID))
+			continue
+		}
+		if pinned, ok := image.Flags["pinned"].(bool); ok && pinned {
+			result = multierror.Append(result, errors.Errorf("image %q is pinned", image.ID))
+			continue
+		}
+		if opts.RequireUntagged && len(image.Names) != 0 {
+			result = multierror.Append(result, errors.Errorf("image %q is still tagged: %v", image.ID, image.Names))
+			continue
+		}
+		resolved = append(resolved, image.ID)
+	}
+	ordered, err := r.DeletionOrder(resolved)
+	if err != nil {
+		return nil, multierror.Append(result, err).ErrorOrNil()
+	}
+	var deleted []string
+	for _, id := range ordered {
+		deletedID, err := r.deleteImage(id)
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		deleted = append(deleted, deletedID)
+	}
+	if len(deleted) > 0 {
+		if err := r.Save(); err != nil {
+			return deleted, multierror.Append(result, err).ErrorOrNil()
+		}
+	}
+	for _, id := range deleted {
+		if err := os.RemoveAll(r.datadir(id)); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return deleted, result.ErrorOrNil()
+}
+
+func (r *imageStore) Get(id string) (*Image, error) {
+	if r.cache != nil {
+		if image, ok := r.cache.get(id); ok {
+			return image, nil
+		}
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	cp := copyImage(image)
+	if r.cache != nil {
+		r.cache.add(id, cp)
+	}
+	return cp, nil
+}
+
+// GetRef returns the internal, uncopied Image record for id, along with a
+// release function that the caller must invoke exactly once when it is done
+// with the handle.  Unlike Get, it does not copyImage the result, so it
+// avoids an allocation-heavy copy for callers that only read and discard the
+// record, such as hot inspect paths.
+//
+// GetRef acquires the store's read lock itself and holds it until the
+// release function is called, so the caller must not hold or re-acquire the
+// lock, must call the release function promptly, and must under no
+// circumstances mutate the returned *Image or any of its slices/maps: doing
+// so corrupts the in-memory store for every other caller.  The release
+// function is idempotent, so calling it more than once (e.g. a deferred
+// call alongside an explicit early-return call) is a no-op rather than
+// double-unlocking the store lock, which would otherwise panic.  When in
+// doubt, use the safe, copying Get instead.
+func (r *imageStore) GetRef(id string) (*Image, func(), error) {
+	r.RLock()
+	image, ok := r.lookup(id)
+	if !ok {
+		r.Unlock()
+		return nil, nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	var once sync.Once
+	release := func() { once.Do(r.Unlock) }
+	return image, release, nil
+}
+
+func (r *imageStore) Lookup(name string) (id string, err error) {
+	if image, ok := r.lookup(name); ok {
+		return image.ID, nil
+	}
+	return "", errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (r *imageStore) Exists(id string) bool {
+	_, ok := r.lookup(id)
+	return ok
+}
+
+func (r *imageStore) ByDigest(d digest.Digest) ([]*Image, error) {
+	if images, ok := r.bydigest[d]; ok {
+		return copyImageSlice(images), nil
+	}
+	return nil, errors.Wrapf(ErrImageUnknown, "error locating image with digest %q", d)
+}
+
+func (r *imageStore) ByName(name string) ([]*Image, error) {
+	if image, ok := r.byname[name]; ok {
+		return []*Image{copyImage(image)}, nil
+	}
+	return nil, errors.Wrapf(ErrImageUnknown, "error locating image with name %q", name)
+}
+
+// ImagesByRetentionClass returns copies of all images whose RetentionClass
+// matches the specified value, for use by external lifecycle/pruning
+// policies.  Evaluating the policy itself is left to the caller.
+func (r *imageStore) ImagesByRetentionClass(class string) ([]Image, error) {
+	images := []Image{}
+	for _, image := range r.images {
+		if image.RetentionClass == class {
+			images = append(images, *copyImage(image))
+		}
+	}
+	return images, nil
+}
+
+// Counts returns the number of images, names, and distinct digests
+// currently indexed, without materializing any slices.
+func (r *imageStore) Counts() (images, names, digests int) {
+	return len(r.byid), len(r.byname), len(r.bydigest)
+}
+
+// ExistsMany reports, for each of the given IDs or names, whether it
+// resolves to a known image.  It does all of the lookups under the one
+// RLock the caller is expected to already be holding, which is cheaper than
+// calling Exists in a loop.
+func (r *imageStore) ExistsMany(ids []string) map[string]bool {
+	result := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		_, ok := r.lookup(id)
+		result[id] = ok
+	}
+	return result
+}
+
+// NamesForDigest returns the union of Names across every image indexed
+// under digest d, deduplicated, for UIs that want to show a manifest
+// digest's human-readable names.  It returns an empty slice, not an error,
+// for a digest that matches no image.
+func (r *imageStore) NamesForDigest(d digest.Digest) ([]string, error) {
+	seen := make(map[string]struct{})
+	names := []string{}
+	for _, image := range r.bydigest[d] {
+		for _, name := range image.Names {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// NameConflicts reports, for each name in names that byname currently
+// resolves, the ID of the image holding it, so a caller about to retag can
+// warn about what it would steal the name away from. It's a read-only
+// lookup against the in-memory index and makes no changes.
+func (r *imageStore) NameConflicts(names []string) (map[string]string, error) {
+	conflicts := make(map[string]string)
+	for _, name := range names {
+		if image, ok := r.byname[name]; ok {
+			conflicts[name] = image.ID
+		}
+	}
+	return conflicts, nil
+}
+
+// NamesMatching returns every name in the store's byname index that matches
+// pattern according to filepath.Match-style globbing, mapped to the ID of
+// the image holding it, for repository-wildcard listing like `podman images
+// 'registry.example.com/*'` where a plain prefix search isn't flexible
+// enough.
+func (r *imageStore) NamesMatching(pattern string) (map[string]string, error) {
+	matches := make(map[string]string)
+	for name, image := range r.byname {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error matching pattern %q against name %q", pattern, name)
+		}
+		if matched {
+			matches[name] = image.ID
+		}
+	}
+	return matches, nil
+}
+
+// SearchByNamePattern returns copies of every image with at least one name
+// matching pattern, by filepath.Match-style globbing, without duplicating
+// an image that matches on more than one name.
+func (r *imageStore) SearchByNamePattern(pattern string) ([]*Image, error) {
+	seen := make(map[string]struct{})
+	var matches []*Image
+	for _, image := range r.images {
+		for _, name := range image.Names {
+			matched, err := filepath.Match(pattern, name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error matching pattern %q against name %q", pattern, name)
+			}
+			if matched {
+				if _, ok := seen[image.ID]; !ok {
+					seen[image.ID] = struct{}{}
+					matches = append(matches, copyImage(image))
+				}
+				break
+			}
+		}
+	}
+	return matches, nil
+}
+
+// ByCreatedRange returns copies of every image whose Created falls within
+// [start, end], inclusive.  Images with a zero Created are excluded.
+func (r *imageStore) ByCreatedRange(start, end time.Time) ([]*Image, error) {
+	var matches []*Image
+	for _, image := range r.images {
+		if image.Created.IsZero() {
+			continue
+		}
+		if image.Created.Before(start) || image.Created.After(end) {
+			continue
+		}
+		matches = append(matches, copyImage(image))
+	}
+	return matches, nil
+}
+
+// ImagesWithBigData returns copies of all images that have a big data item
+// named key, scanning BigDataNames in memory.  It's used by migrations that
+// only need to touch images possessing a particular item, such as ones that
+// already carry a signature.
+func (r *imageStore) ImagesWithBigData(key string) ([]*Image, error) {
+	var matches []*Image
+	for _, image := range r.images {
+		for _, name := range image.BigDataNames {
+			if name == key {
+				matches = append(matches, copyImage(image))
+				break
+			}
+		}
+	}
+	return matches, nil
+}
+
+// ImagesMissingBigData returns copies of every image whose BigDataNames
+// doesn't include key, the complement of ImagesWithBigData, for compliance
+// scans like "which images are unsigned?" against a key that policy
+// requires every image to carry.
+func (r *imageStore) ImagesMissingBigData(key string) ([]*Image, error) {
+	var matches []*Image
+	for _, image := range r.images {
+		found := false
+		for _, name := range image.BigDataNames {
+			if name == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			matches = append(matches, copyImage(image))
+		}
+	}
+	return matches, nil
+}
+
+// ImagesWithoutDigest returns copies of every image with no Digest and no
+// Digests, which are typically locally-built images that were never pulled
+// from or pushed to a registry, for UIs that want to distinguish built
+// images from pulled ones.
+func (r *imageStore) ImagesWithoutDigest() ([]*Image, error) {
+	var matches []*Image
+	for _, image := range r.images {
+		if image.Digest == "" && len(image.Digests) == 0 {
+			matches = append(matches, copyImage(image))
+		}
+	}
+	return matches, nil
+}
+
+// ImagesByIDPrefix returns copies of every image whose ID starts with
+// prefix.  It resolves candidates via the idindex's tree rather than
+// scanning r.images, so it stays cheap even with a short, widely-matching
+// prefix.  It returns no matches if SetDisableTruncIndex(true) skipped
+// building idindex.
+func (r *imageStore) ImagesByIDPrefix(prefix string) ([]*Image, error) {
+	if r.idindex == nil {
+		return []*Image{}, nil
+	}
+	ids, err := r.idindex.GetAll(prefix)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]*Image, 0, len(ids))
+	for _, id := range ids {
+		if image, ok := r.byid[id]; ok {
+			matches = append(matches, copyImage(image))
+		}
+	}
+	return matches, nil
+}
+
+// Query evaluates q against the store in one pass.  When q.Digest is set,
+// it starts from r.bydigest, the most selective index available; otherwise
+// when q.NamePrefix is set and looks like a full name, r.byname narrows the
+// candidate set; failing either, it falls back to scanning r.images.  Every
+// remaining predicate is then applied to each candidate in a single pass.
+func (r *imageStore) Query(q ImageQuery) ([]Image, error) {
+	var candidates []*Image
+	switch {
+	case q.Digest != "":
+		candidates = r.bydigest[q.Digest]
+	case q.NamePrefix != "" && strings.Contains(q.NamePrefix, "/"):
+		if img, ok := r.byname[q.NamePrefix]; ok {
+			candidates = []*Image{img}
+		}
+	default:
+		candidates = r.images
+	}
+	var matches []Image
+	for _, img := range candidates {
+		if q.NamePrefix != "" {
+			found := false
+			for _, name := range img.Names {
+				if strings.HasPrefix(name, q.NamePrefix) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if q.Digest != "" {
+			matched := img.Digest == q.Digest
+			for _, d := range img.Digests {
+				if d == q.Digest {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		if !q.CreatedAfter.IsZero() && img.Created.Before(q.CreatedAfter) {
+			continue
+		}
+		if !q.CreatedBefore.IsZero() && img.Created.After(q.CreatedBefore) {
+			continue
+		}
+		flagsMatch := true
+		for key, value := range q.Flags {
+			if img.Flags[key] != value {
+				flagsMatch = false
+				break
+			}
+		}
+		if !flagsMatch {
+			continue
+		}
+		matches = append(matches, *copyImage(img))
+	}
+	return matches, nil
+}
+
+// ImageModifiedSince reports whether the image with the given ID has been
+// mutated since the caller last observed generation gen.
+func (r *imageStore) ImageModifiedSince(id string, gen uint64) (bool, uint64, error) {
+	image, ok := r.lookup(id)
+	if !ok {
+		return false, 0, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	current := r.generations[image.ID]
+	return current != gen, current, nil
+}
+
+// RemovableImages returns the images with no remaining Names for which
+// inUse reports false, skipping any image pinned via its "pinned" flag or
+// marked ReadOnly.
+func (r *imageStore) RemovableImages(inUse func(imageID string) bool) ([]*Image, error) {
+	var removable []*Image
+	for _, image := range r.images {
+		if len(image.Names) != 0 {
+			continue
+		}
+		if image.ReadOnly {
+			continue
+		}
+		if pinned, ok := image.Flags["pinned"].(bool); ok && pinned {
+			continue
+		}
+		if inUse(image.ID) {
+			continue
+		}
+		removable = append(removable, copyImage(image))
+	}
+	return removable, nil
+}
+
+// RelabelDataDir applies label to an image's datadir and its contents via
+// the platform SELinux API, under the store lock.  It's a no-op on systems
+// where SELinux isn't enabled.
+func (r *imageStore) RelabelDataDir(id string, label string) error {
+	if !selinux.GetEnabled() {
+		return nil
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	return selinux.Chcon(r.datadir(image.ID), label, true)
+}
+
+// ExportOCILayout writes the big data items of the images in ids into an
+// OCI image layout directory at dir, mapping each item to a blob by its
+// stored digest and indexing the ones recognized as manifests.  It does not
+// copy layer contents.
+func (r *imageStore) ExportOCILayout(ids []string, dir string) error {
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0700); err != nil {
+		return err
+	}
+	layout := v1.ImageLayout{Version: v1.ImageLayoutVersion}
+	layoutData, err := json.Marshal(&layout)
+	if err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(filepath.Join(dir, v1.ImageLayoutFile), layoutData, 0600); err != nil {
+		return err
+	}
+	var manifests []v1.Descriptor
+	for _, id := range ids {
+		image, ok := r.lookup(id)
+		if !ok {
+			return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+		}
+		for _, key := range image.BigDataNames {
+			data, err := r.BigData(image.ID, key)
+			if err != nil {
+				return err
+			}
+			itemDigest := image.BigDataDigests[key]
+			if itemDigest == "" {
+				itemDigest = digest.Canonical.FromBytes(data)
+			}
+			blobPath := filepath.Join(dir, "blobs", itemDigest.Algorithm().String(), itemDigest.Encoded())
+			if err := os.MkdirAll(filepath.Dir(blobPath), 0700); err != nil {
+				return err
+			}
+			if err := ioutils.AtomicWriteFile(blobPath, data, 0600); err != nil {
+				return err
+			}
+			if r.isManifest(key) {
+				manifests = append(manifests, v1.Descriptor{
+					MediaType: v1.MediaTypeImageManifest,
+					Digest:    itemDigest,
+					Size:      int64(len(data)),
+				})
+			}
+		}
+	}
+	index := v1.Index{
+		Versioned: imagespecs.Versioned{SchemaVersion: 2},
+		Manifests: manifests,
+	}
+	indexData, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(filepath.Join(dir, "index.json"), indexData, 0600)
+}
+
+// ExportJSONL writes one JSON object per line to w, one line for every
+// image for which filter returns true, or every image if filter is nil,
+// so that piping a large store into jq-based tooling doesn't require
+// buffering one huge array.  Each line's field ordering follows Image's
+// declaration order, the same as any other json.Marshal of an *Image, so
+// output for a given store is reproducible across runs.
+func (r *imageStore) ExportJSONL(w io.Writer, filter func(*Image) bool) error {
+	for _, image := range r.images {
+		if filter != nil && !filter(image) {
+			continue
+		}
+		data, err := json.Marshal(copyImage(image))
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling image with ID %q", image.ID)
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageStoreState is the on-the-wire form used by DumpState/LoadState: the
+// full canonical image list, the one thing every derived index (byid,
+// byname, bydigest, idindex) can be rebuilt from in a single pass.
+type imageStoreState struct {
+	Images []*Image `json:"images"`
+}
+
+// DumpState serializes the store's canonical image list for LoadState. See
+// the ImageStore interface for the rationale.
+func (r *imageStore) DumpState() ([]byte, error) {
+	images := make([]*Image, len(r.images))
+	for i, image := range r.images {
+		images[i] = copyImage(image)
+	}
+	return json.Marshal(&imageStoreState{Images: images})
+}
+
+// LoadState replaces the store's in-memory indexes with the ones encoded in
+// data, as produced by DumpState. See the ImageStore interface for the
+// rationale.
+func (r *imageStore) LoadState(data []byte) error {
+	state := imageStoreState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	images := make([]*Image, 0, len(state.Images))
+	idlist := make([]string, 0, len(state.Images))
+	byid := make(map[string]*Image)
+	byname := make(map[string]*Image)
+	bydigest := make(map[digest.Digest][]*Image)
+	for _, image := range state.Images {
+		image := copyImage(image)
+		images = append(images, image)
+		idlist = append(idlist, image.ID)
+		byid[image.ID] = image
+		for _, name := range image.Names {
+			byname[name] = image
+		}
+		for _, d := range image.Digests {
+			bydigest[d] = append(bydigest[d], image)
+		}
+	}
+	r.images = images
+	if r.disableTruncIndex {
+		r.idindex = nil
+	} else {
+		r.idindex = truncindex.NewTruncIndex(idlist)
+	}
+	r.byid = byid
+	r.byname = byname
+	r.bydigest = bydigest
+	r.invalidateCache()
+	return nil
+}
+
+// FindDigestInconsistencies returns the IDs of images whose Digest isn't
+// present in their own Digests.
+func (r *imageStore) FindDigestInconsistencies() ([]string, error) {
+	var inconsistent []string
+	for _, image := range r.images {
+		if image.Digest == "" {
+			continue
+		}
+		found := false
+		for _, d := range image.Digests {
+			if d == image.Digest {
+				found = true
+				break
+			}
+		}
+		if !found {
+			inconsistent = append(inconsistent, image.ID)
+		}
+	}
+	return inconsistent, nil
+}
+
+// RepairDigestInconsistencies re-runs recomputeDigests and Saves for every
+// image FindDigestInconsistencies reports, and returns the IDs it repaired.
+func (r *imageStore) RepairDigestInconsistencies() ([]string, error) {
+	ids, err := r.FindDigestInconsistencies()
+	if err != nil {
+		return nil, err
+	}
+	var repaired []string
+	for _, id := range ids {
+		image, ok := r.lookup(id)
+		if !ok {
+			continue
+		}
+		if err := image.recomputeDigests(r.isManifest); err != nil {
+			return repaired, errors.Wrapf(err, "error recomputing digests for image %s", image.ID)
+		}
+		r.bumpGeneration(image.ID)
+		if err := r.Save(); err != nil {
+			return repaired, err
+		}
+		repaired = append(repaired, image.ID)
+	}
+	return repaired, nil
+}
+
+// VerifyDigestsAgainst calls exists for every digest in the store's digest
+// index and returns those for which it reports false, i.e. digests the
+// index claims are backed by a blob that the external blob store no longer
+// has. It makes no changes of its own; callers decide what, if anything, to
+// do about the digests it reports.
+func (r *imageStore) VerifyDigestsAgainst(exists func(d digest.Digest) (bool, error)) ([]digest.Digest, error) {
+	var missing []digest.Digest
+	for d := range r.bydigest {
+		ok, err := exists(d)
+		if err != nil {
+			return missing, errors.Wrapf(err, "error checking whether blob store has digest %q", d)
+		}
+		if !ok {
+			missing = append(missing, d)
+		}
+	}
+	return missing, nil
+}
+
+// ManifestDigest returns the digest of the big data item that identifies
+// image id, centralizing logic that callers otherwise duplicate against
+// BigDataNames and isManifest themselves. If more than one item qualifies,
+// it prefers the one named ImageDigestManifestBigDataNamePrefix; if that
+// doesn't resolve the ambiguity, it returns an error instead of guessing.
+func (r *imageStore) ManifestDigest(id string) (digest.Digest, error) {
+	image, ok := r.lookup(id)
+	if !ok {
+		return "", errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	var candidates []string
+	for _, name := range image.BigDataNames {
+		if r.isManifest(name) {
+			candidates = append(candidates, name)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return "", errors.Wrapf(ErrDigestUnknown, "image %q has no manifest big data item", id)
+	case 1:
+		return image.BigDataDigests[candidates[0]], nil
+	}
+	for _, name := range candidates {
+		if name == ImageDigestManifestBigDataNamePrefix {
+			return image.BigDataDigests[name], nil
+		}
+	}
+	return "", errors.Errorf("image %q has multiple ambiguous manifest big data items: %v", id, candidates)
+}
+
+// DeletionOrder topologically sorts ids so that, whenever one image's
+// TopLayer appears in another's MappedTopLayers, the one referencing it as
+// a mapped layer comes first.  Images with no such relationship keep their
+// input relative order.
+func (r *imageStore) DeletionOrder(ids []string) ([]string, error) {
+	images := make(map[string]*Image, len(ids))
+	for _, id := range ids {
+		image, ok := r.lookup(id)
+		if !ok {
+			return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+		}
+		images[image.ID] = image
+	}
+	// dependsOn[a] holds the IDs that must be ordered before a: those
+	// referencing a's TopLayer as one of their own MappedTopLayers.
+	dependsOn := make(map[string][]string, len(images))
+	for aID, a := range images {
+		for bID, b := range images {
+			if aID == bID {
+				continue
+			}
+			for _, mapped := range b.MappedTopLayers {
+				if mapped == a.TopLayer {
+					dependsOn[aID] = append(dependsOn[aID], bID)
+				}
+			}
+		}
+	}
+	var ordered []string
+	placed := make(map[string]bool, len(images))
+	var place func(id string) error
+	place = func(id string) error {
+		if placed[id] {
+			return nil
+		}
+		placed[id] = true // mark early to guard against cycles
+		for _, dep := range dependsOn[id] {
+			if err := place(dep); err != nil {
+				return err
+			}
+		}
+		ordered = append(ordered, id)
+		return nil
+	}
+	for _, id := range ids {
+		image, ok := r.lookup(id)
+		if !ok {
+			continue
+		}
+		if err := place(image.ID); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// LayerReferenceCounts returns, for every layer ID referenced as an image's
+// TopLayer or one of its MappedTopLayers, the number of images referencing
+// it.
+func (r *imageStore) LayerReferenceCounts() (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, image := range r.images {
+		if image.TopLayer != "" {
+			counts[image.TopLayer]++
+		}
+		for _, layer := range image.MappedTopLayers {
+			counts[layer]++
+		}
+	}
+	return counts, nil
+}
+
+// ImagesByHistoryLength returns the images whose NamesHistory has at least
+// min entries.
+func (r *imageStore) ImagesByHistoryLength(min int) ([]Image, error) {
+	var matches []Image
+	for _, image := range r.images {
+		if len(image.NamesHistory) >= min {
+			matches = append(matches, *copyImage(image))
+		}
+	}
+	return matches, nil
+}
+
+// ImagesWithFutureCreated returns the images whose Created is after now,
+// surfacing the clock-skew or bad-build-timestamp records that would
+// otherwise silently break age-based pruning.  See ClampCreated for a way
+// to correct one.
+func (r *imageStore) ImagesWithFutureCreated(now time.Time) ([]*Image, error) {
+	var matches []*Image
+	for _, image := range r.images {
+		if image.Created.After(now) {
+			matches = append(matches, copyImage(image))
+		}
+	}
+	return matches, nil
+}
+
+// LargeBigData returns, per image ID, the names and sizes of big data items
+// at least minBytes, filling in sizes that aren't recorded in BigDataSizes
+// by statting the item on disk.
+func (r *imageStore) LargeBigData(minBytes int64) (map[string]map[string]int64, error) {
+	result := make(map[string]map[string]int64)
+	for _, image := range r.images {
+		for _, key := range image.BigDataNames {
+			size, ok := image.BigDataSizes[key]
+			if !ok {
+				info, err := os.Stat(r.bigDataPath(image, key))
+				if err != nil {
+					continue
+				}
+				size = info.Size()
+			}
+			if size < minBytes {
+				continue
+			}
+			if result[image.ID] == nil {
+				result[image.ID] = make(map[string]int64)
+			}
+			result[image.ID][key] = size
+		}
+	}
+	return result, nil
+}
+
+// VerifyAll streams per-item digest verification results to report as it
+// scans the store, taking only the read lock and checking ctx between
+// images so a long-running scan can be canceled.
+func (r *imageStore) VerifyAll(ctx context.Context, report func(id, key string, ok bool, err error)) error {
+	r.RLock()
+	defer r.Unlock()
+	for _, image := range r.images {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		for key, expected := range image.BigDataDigests {
+			data, err := ioutil.ReadFile(r.bigDataPath(image, key))
+			if err != nil {
+				report(image.ID, key, false, err)
+				continue
+			}
+			actual := digest.Canonical.FromBytes(data)
+			if actual != expected {
+				report(image.ID, key, false, errors.Errorf("digest mismatch for %q: got %q, want %q", key, actual, expected))
+				continue
+			}
+			report(image.ID, key, true, nil)
+		}
+	}
+	return nil
+}
+
+// DetectNameCollisions compares this store's names against other's, calling
+// warn once for every name defined in both stores with the competing image
+// IDs.
+func (r *imageStore) DetectNameCollisions(other ROImageStore, warn func(name string, ids []string)) error {
+	for name, image := range r.byname {
+		otherID, err := other.Lookup(name)
+		if err != nil {
+			continue
+		}
+		if otherID != image.ID {
+			warn(name, []string{image.ID, otherID})
+		}
+	}
+	return nil
+}
+
+func (r *imageStore) BigData(id, key string) ([]byte, error) {
+	if key == "" {
+		return nil, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve image big data value for empty name")
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	lock := r.bigDataLock(image.ID)
+	lock.RLock()
+	data, err := ioutil.ReadFile(r.bigDataPath(image, key))
+	lock.RUnlock()
+	if err != nil {
+		return nil, wrapFSError(err, ErrBigDataUnknown)
+	}
+	if r.bigDataReadTransform != nil {
+		return r.bigDataReadTransform(key, data)
+	}
+	return data, nil
+}
+
+// BigDataRange reads length bytes starting at offset from a big data item,
+// seeking into the file instead of reading it whole, for callers that only
+// need a header or other slice of a large manifest or OCI artifact blob.
+// It validates the range against the item's actual on-disk size and
+// returns an error instead of a short read if it doesn't fit.  Unlike
+// BigData, it reads raw on-disk bytes and never applies a read transform
+// installed via SetBigDataTransforms, since a transform assumes it's
+// operating on the whole item.
+func (r *imageStore) BigDataRange(id, key string, offset, length int64) ([]byte, error) {
+	if key == "" {
+		return nil, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve image big data value for empty name")
+	}
+	if offset < 0 || length < 0 {
+		return nil, errors.Errorf("invalid range: offset %d, length %d", offset, length)
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	lock := r.bigDataLock(image.ID)
+	lock.RLock()
+	defer lock.RUnlock()
+	f, err := os.Open(r.bigDataPath(image, key))
+	if err != nil {
+		return nil, wrapFSError(err, ErrBigDataUnknown)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if offset+length > info.Size() {
+		return nil, errors.Errorf("requested range [%d, %d) is out of bounds for big data item %q, which is %d bytes", offset, offset+length, key, info.Size())
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// SetBigDataTransforms installs optional hooks through which big data items
+// are passed on every read and write, for transparent migration of legacy
+// formats (e.g. normalizing manifests on read without rewriting the store).
+// Either may be nil, in which case that direction is left untouched. The
+// digest recorded for an item is always computed from the bytes that
+// BigData will return for it, i.e. the post-write-transform, on-disk bytes,
+// so that BigDataDigest stays consistent with what callers actually read.
+func (r *imageStore) SetBigDataTransforms(read, write func(key string, data []byte) ([]byte, error)) {
+	r.bigDataReadTransform = read
+	r.bigDataWriteTransform = write
+}
+
+func (r *imageStore) BigDataSize(id, key string) (int64, error) {
+	if key == "" {
+		return -1, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve size of image big data with empty name")
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return -1, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if image.BigDataSizes == nil {
+		image.BigDataSizes = make(map[string]int64)
+	}
+	if size, ok := image.BigDataSizes[key]; ok {
+		return size, nil
+	}
+	if data, err := r.BigData(id, key); err == nil && data != nil {
+		return int64(len(data)), nil
+	}
+	return -1, ErrSizeUnknown
+}
+
+func (r *imageStore) BigDataDigest(id, key string) (digest.Digest, error) {
+	if key == "" {
+		return "", errors.Wrapf(ErrInvalidBigDataName, "can't retrieve digest of image big data value with empty name")
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return "", errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if image.BigDataDigests == nil {
+		image.BigDataDigests = make(map[string]digest.Digest)
+	}
+	if d, ok := image.BigDataDigests[key]; ok {
+		return d, nil
+	}
+	return "", ErrDigestUnknown
+}
+
+func (r *imageStore) BigDataNames(id string) ([]string, error) {
+	image, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	return copyStringSlice(image.BigDataNames), nil
+}
+
+func imageSliceWithoutValue(slice []*Image, value *Image) []*Image {
+	modified := make([]*Image, 0, len(slice))
+	for _, v := range slice {
+		if v == value {
+			continue
+		}
+		modified = append(modified, v)
+	}
+	return modified
+}
+
+func (r *imageStore) SetBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error {
+	if key == "" {
+		return errors.Wrapf(ErrInvalidBigDataName, "can't set empty name for image big data item")
+	}
+	if !r.IsReadWrite() {
+		return r.readOnlyError("save data items associated with images")
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	err := os.MkdirAll(r.datadir(image.ID), 0700)
+	if err != nil {
+		return wrapFSError(err, nil)
+	}
+	if r.minFreeBytes > 0 {
+		free, ok, err := system.FreeSpace(r.datadir(image.ID))
+		if err != nil {
+			return errors.Wrapf(err, "error checking free space before writing big data item %q", key)
+		}
+		if ok && free < r.minFreeBytes {
+			return errors.Wrapf(ErrInsufficientSpace, "only %d bytes free, need at least %d", free, r.minFreeBytes)
+		}
+	}
+	if r.bigDataWriteTransform != nil {
+		if data, err = r.bigDataWriteTransform(key, data); err != nil {
+			return errors.Wrapf(err, "error transforming big data item %q for write", key)
+		}
+	}
+	var newDigest digest.Digest
+	if r.isManifest(key) {
+		if digestManifest == nil {
+			return errors.Wrapf(ErrDigestUnknown, "error digesting manifest: no manifest digest callback provided")
+		}
+		if newDigest, err = digestManifest(data); err != nil {
+			return errors.Wrapf(err, "error digesting manifest")
+		}
+	} else {
+		newDigest = digest.Canonical.FromBytes(data)
+	}
+	lock := r.bigDataLock(image.ID)
+	lock.Lock()
+	err = wrapFSError(r.atomicWriteFile(filepath.Join(r.datadir(image.ID), r.assignBigDataBaseName(image, key)), data, 0600), nil)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return r.recordBigData(image, key, int64(len(data)), newDigest)
+}
+
+// refreshBigDataDigestIndex drops image from r.bydigest under each digest it
+// was previously indexed under, calls recomputeDigests to rebuild
+// image.Digests from its current big data items, and adds image back to
+// r.bydigest under each of those.  Callers that change which big data items
+// an image has, or their contents, must call this before Save so the
+// digest-based index reflects the change.
+func (r *imageStore) refreshBigDataDigestIndex(image *Image) error {
+	for _, oldDigest := range image.Digests {
+		// remove the image from the list of images in the digest-based index
+		if list, ok := r.bydigest[oldDigest]; ok {
+			prunedList := imageSliceWithoutValue(list, image)
+			if len(prunedList) == 0 {
+				delete(r.bydigest, oldDigest)
+			} else {
+				r.bydigest[oldDigest] = prunedList
+			}
+		}
+	}
+	if err := image.recomputeDigests(r.isManifest); err != nil {
+		return errors.Wrapf(err, "error loading recomputing image digest information for %s", image.ID)
+	}
+	for _, newDigest := range image.Digests {
+		// add the image to the list of images in the digest-based index which
+		// corresponds to the new digest for this item, unless it's already there
+		list := r.bydigest[newDigest]
+		if len(list) == len(imageSliceWithoutValue(list, image)) {
+			// the list isn't shortened by trying to prune this image from it,
+			// so it's not in there yet
+			r.bydigest[newDigest] = append(list, image)
+		}
+	}
+	return nil
+}
+
+// recordBigData updates image's BigDataSizes/BigDataDigests/BigDataNames
+// and the digest-based index to reflect a big data item named key that was
+// just written to disk with the given size and digest, saving once if
+// anything actually changed.  It's shared by SetBigData and
+// SetBigDataFromReader, which differ only in how the item's bytes reach
+// disk.
+func (r *imageStore) recordBigData(image *Image, key string, size int64, newDigest digest.Digest) error {
+	save := false
+	if image.BigDataSizes == nil {
+		image.BigDataSizes = make(map[string]int64)
+	}
+	oldSize, sizeOk := image.BigDataSizes[key]
+	image.BigDataSizes[key] = size
+	if image.BigDataDigests == nil {
+		image.BigDataDigests = make(map[string]digest.Digest)
+	}
+	oldDigest, digestOk := image.BigDataDigests[key]
+	image.BigDataDigests[key] = newDigest
+	if !sizeOk || oldSize != image.BigDataSizes[key] || !digestOk || oldDigest != newDigest {
+		save = true
+	}
+	addName := true
+	for _, name := range image.BigDataNames {
+		if name == key {
+			addName = false
+			break
+		}
+	}
+	if addName {
+		image.BigDataNames = append(image.BigDataNames, key)
+		save = true
+	}
+	if err := r.refreshBigDataDigestIndex(image); err != nil {
+		return err
+	}
+	if save {
+		r.bumpGeneration(image.ID)
+		return r.Save()
+	}
+	return nil
+}
+
+// SetBigDataFromReader is like SetBigData, but streams src to a temp file
+// under the image's data directory and atomically renames it into place,
+// instead of requiring the caller to buffer the whole payload first.  For
+// manifest-named keys, digestManifest still needs the complete bytes to
+// compute a digest, so those are buffered exactly as SetBigData would be;
+// non-manifest keys are hashed with digest.Canonical while they stream, so
+// they're never held whole.  Because the item isn't loaded whole, a write
+// transform installed via SetBigDataTransforms is not applied to streamed
+// non-manifest items.
+func (r *imageStore) SetBigDataFromReader(id, key string, src io.Reader, digestManifest func([]byte) (digest.Digest, error)) error {
+	if key == "" {
+		return errors.Wrapf(ErrInvalidBigDataName, "can't set empty name for image big data item")
+	}
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to save data items associated with images at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if r.isManifest(key) {
+		data, err := ioutil.ReadAll(src)
+		if err != nil {
+			return errors.Wrapf(err, "error reading manifest big data item %q", key)
+		}
+		return r.SetBigData(id, key, data, digestManifest)
+	}
+	if err := os.MkdirAll(r.datadir(image.ID), 0700); err != nil {
+		return wrapFSError(err, nil)
+	}
+	if r.minFreeBytes > 0 {
+		free, ok, err := system.FreeSpace(r.datadir(image.ID))
+		if err != nil {
+			return errors.Wrapf(err, "error checking free space before writing big data item %q", key)
+		}
+		if ok && free < r.minFreeBytes {
+			return errors.Wrapf(ErrInsufficientSpace, "only %d bytes free, need at least %d", free, r.minFreeBytes)
+		}
+	}
+	path := filepath.Join(r.datadir(image.ID), r.assignBigDataBaseName(image, key))
+	w, err := ioutils.NewAtomicFileWriterWithOpts(path, 0600, &ioutils.AtomicFileWriterOptions{NoSync: r.skipSync})
+	if err != nil {
+		return wrapFSError(err, nil)
+	}
+	digester := digest.Canonical.Digester()
+	lock := r.bigDataLock(image.ID)
+	lock.Lock()
+	size, copyErr := io.Copy(io.MultiWriter(w, digester.Hash()), src)
+	closeErr := w.Close()
+	lock.Unlock()
+	if copyErr != nil {
+		return wrapFSError(copyErr, nil)
+	}
+	if closeErr != nil {
+		return wrapFSError(closeErr, nil)
+	}
+	return r.recordBigData(image, key, size, digester.Digest())
+}
+
+// RenameBigData renames big data item oldKey to newKey without rewriting
+// its contents: it renames the on-disk file, moves the BigDataSizes and
+// BigDataDigests entries, and updates BigDataNames.  If oldKey or newKey is
+// manifest-like (see SetIsManifestKey), it also recomputes the image's
+// digests and refreshes r.bydigest, since renaming a manifest item can
+// change or remove the image's digest index membership.  It fails if
+// newKey already names an existing big data item.
+func (r *imageStore) RenameBigData(id, oldKey, newKey string) error {
+	if oldKey == "" || newKey == "" {
+		return errors.Wrapf(ErrInvalidBigDataName, "can't rename to or from an empty big data name")
+	}
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to rename data items associated with images at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	oldIndex := -1
+	for i, name := range image.BigDataNames {
+		if name == oldKey {
+			oldIndex = i
+		}
+		if name == newKey {
+			return errors.Errorf("image %q already has a big data item named %q", image.ID, newKey)
+		}
+	}
+	if oldIndex == -1 {
+		return errors.Wrapf(ErrBigDataUnknown, "image %q has no big data item named %q", image.ID, oldKey)
+	}
+	oldPath := r.bigDataPath(image, oldKey)
+	newPath := filepath.Join(r.datadir(image.ID), r.assignBigDataBaseName(image, newKey))
+	lock := r.bigDataLock(image.ID)
+	lock.Lock()
+	err := wrapFSError(os.Rename(oldPath, newPath), nil)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if image.BigDataFileNames != nil {
+		delete(image.BigDataFileNames, oldKey)
+	}
+	image.BigDataNames[oldIndex] = newKey
+	if size, ok := image.BigDataSizes[oldKey]; ok {
+		delete(image.BigDataSizes, oldKey)
+		image.BigDataSizes[newKey] = size
+	}
+	if d, ok := image.BigDataDigests[oldKey]; ok {
+		delete(image.BigDataDigests, oldKey)
+		image.BigDataDigests[newKey] = d
+	}
+	if r.isManifest(oldKey) || r.isManifest(newKey) {
+		if err := r.refreshBigDataDigestIndex(image); err != nil {
+			return err
+		}
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// DeleteBigData removes a big data item, deleting its on-disk file and its
+// BigDataNames/BigDataSizes/BigDataDigests entries.  If key is manifest-like
+// (see SetIsManifestKey), removing it can change or remove the image's
+// Digests, so the digest index is recomputed and r.bydigest refreshed to
+// match. It Saves exactly once.
+func (r *imageStore) DeleteBigData(id, key string) error {
+	if key == "" {
+		return errors.Wrapf(ErrInvalidBigDataName, "can't remove empty big data name")
+	}
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete data items associated with images at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	index := -1
+	for i, name := range image.BigDataNames {
+		if name == key {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return errors.Wrapf(ErrBigDataUnknown, "image %q has no big data item named %q", image.ID, key)
+	}
+	path := r.bigDataPath(image, key)
+	lock := r.bigDataLock(image.ID)
+	lock.Lock()
+	err := wrapFSError(os.Remove(path), nil)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	image.BigDataNames = append(image.BigDataNames[:index], image.BigDataNames[index+1:]...)
+	delete(image.BigDataSizes, key)
+	delete(image.BigDataDigests, key)
+	if image.BigDataFileNames != nil {
+		delete(image.BigDataFileNames, key)
+	}
+	if r.isManifest(key) {
+		if err := r.refreshBigDataDigestIndex(image); err != nil {
+			return err
+		}
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// ExportBigData writes all of the image's big data items to w as a tar
+// stream, using each item's key as its entry name, for backup or export of
+// a single image's metadata.  It streams each item from disk rather than
+// buffering them all in memory.
+func (r *imageStore) ExportBigData(id string, w io.Writer) error {
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	lock := r.bigDataLock(image.ID)
+	tw := tar.NewWriter(w)
+	for _, key := range image.BigDataNames {
+		if err := func() error {
+			lock.RLock()
+			defer lock.RUnlock()
+			f, err := os.Open(r.bigDataPath(image, key))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			hdr := &tar.Header{
+				Name: key,
+				Size: info.Size(),
+				Mode: 0600,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			return err
+		}(); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ImportBigData restores big data items for an image from a tar stream
+// produced by ExportBigData, using each entry's name as the big data key.
+// It updates BigDataSizes/BigDataDigests and the digest index to match the
+// restored items, and saves once all entries have been written.  Items are
+// digested directly from their bytes; manifest-like items restored this way
+// get the canonical digest of their content rather than one derived from a
+// digestManifest callback, since the bundle carries no such callback.
+func (r *imageStore) ImportBigData(id string, tarball io.Reader) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify data items associated with images at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if err := os.MkdirAll(r.datadir(image.ID), 0700); err != nil {
+		return err
+	}
+	if image.BigDataSizes == nil {
+		image.BigDataSizes = make(map[string]int64)
+	}
+	if image.BigDataDigests == nil {
+		image.BigDataDigests = make(map[string]digest.Digest)
+	}
+	tr := tar.NewReader(tarball)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		key := hdr.Name
+		lock := r.bigDataLock(image.ID)
+		lock.Lock()
+		err = r.atomicWriteFile(filepath.Join(r.datadir(image.ID), r.assignBigDataBaseName(image, key)), data, 0600)
+		lock.Unlock()
+		if err != nil {
+			return errors.Wrapf(err, "error restoring big data item %q", key)
+		}
+		image.BigDataSizes[key] = int64(len(data))
+		image.BigDataDigests[key] = digest.Canonical.FromBytes(data)
+		addName := true
+		for _, name := range image.BigDataNames {
+			if name == key {
+				addName = false
+				break
+			}
+		}
+		if addName {
+			image.BigDataNames = append(image.BigDataNames, key)
+		}
+	}
+	for _, oldDigest := range image.Digests {
+		if list, ok := r.bydigest[oldDigest]; ok {
+			prunedList := imageSliceWithoutValue(list, image)
+			if len(prunedList) == 0 {
+				delete(r.bydigest, oldDigest)
+			} else {
+				r.bydigest[oldDigest] = prunedList
+			}
+		}
+	}
+	if err := image.recomputeDigests(r.isManifest); err != nil {
+		return errors.Wrapf(err, "error recomputing image digest information for %s", image.ID)
+	}
+	for _, newDigest := range image.Digests {
+		list := r.bydigest[newDigest]
+		if len(list) == len(imageSliceWithoutValue(list, image)) {
+			r.bydigest[newDigest] = append(list, image)
+		}
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// SetBigDataEncrypted stores ciphertext for a big data item while recording
+// the digest of the corresponding *plaintext* (so the item's identity in
+// BigDataDigests/the digest index is unaffected by encryption) along with
+// which key and algorithm were used.  Encryption and decryption themselves
+// are entirely the caller's responsibility; the store only persists the
+// bytes it's given and the bookkeeping needed to make sense of them later.
+func (r *imageStore) SetBigDataEncrypted(id, key string, ciphertext []byte, plaintextDigest digest.Digest, keyID, algorithm string) error {
+	if key == "" {
+		return errors.Wrapf(ErrInvalidBigDataName, "can't set empty name for image big data item")
+	}
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to save data items associated with images at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if err := os.MkdirAll(r.datadir(image.ID), 0700); err != nil {
+		return err
+	}
+	lock := r.bigDataLock(image.ID)
+	lock.Lock()
+	err := r.atomicWriteFile(filepath.Join(r.datadir(image.ID), r.assignBigDataBaseName(image, key)), ciphertext, 0600)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if image.BigDataSizes == nil {
+		image.BigDataSizes = make(map[string]int64)
+	}
+	if image.BigDataDigests == nil {
+		image.BigDataDigests = make(map[string]digest.Digest)
+	}
+	if image.BigDataEncryption == nil {
+		image.BigDataEncryption = make(map[string]BigDataEncryptionInfo)
+	}
+	image.BigDataSizes[key] = int64(len(ciphertext))
+	image.BigDataDigests[key] = plaintextDigest
+	image.BigDataEncryption[key] = BigDataEncryptionInfo{KeyID: keyID, Algorithm: algorithm}
+	addName := true
+	for _, name := range image.BigDataNames {
+		if name == key {
+			addName = false
+			break
+		}
+	}
+	if addName {
+		image.BigDataNames = append(image.BigDataNames, key)
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+// BigDataEncryption returns the recorded encryption metadata for a big data
+// item, if any was set via SetBigDataEncrypted.  ok is false if the item
+// exists but was never marked as encrypted.
+func (r *imageStore) BigDataEncryption(id, key string) (info BigDataEncryptionInfo, ok bool, err error) {
+	image, found := r.lookup(id)
+	if !found {
+		return BigDataEncryptionInfo{}, false, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	info, ok = image.BigDataEncryption[key]
+	return info, ok, nil
+}
+
+// ForEachImage calls fn once for a copy of every known image, for use by
+// verification passes that want to examine every record.  If stopOnFirstError
+// is true, it returns as soon as fn returns a non-nil error, and holds the
+// read lock for the whole iteration.  If it is false, it keeps going,
+// collecting every error fn returns into one aggregated error returned at
+// the end; callers relying on continue mode for long scans should be aware
+// that the lock is still held throughout, since releasing it mid-iteration
+// would let the slice being scanned change out from under the copies handed
+// to fn.
+func (r *imageStore) ForEachImage(fn func(*Image) error, stopOnFirstError bool) error {
+	r.RLock()
+	defer r.Unlock()
+	if stopOnFirstError {
+		for _, image := range r.images {
+			if err := fn(copyImage(image)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var result *multierror.Error
+	for _, image := range r.images {
+		if err := fn(copyImage(image)); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// ImagesSharingBigData groups the IDs of images that have a big data item
+// named key by that item's digest, revealing how many images share
+// identical content under the given key without reading any files.
+func (r *imageStore) ImagesSharingBigData(key string) (map[digest.Digest][]string, error) {
+	groups := make(map[digest.Digest][]string)
+	for _, image := range r.images {
+		d, ok := image.BigDataDigests[key]
+		if !ok {
+			continue
+		}
+		groups[d] = append(groups[d], image.ID)
+	}
+	return groups, nil
+}
+
+// FindDigestManifestConflicts reports, for every digest indexed by more
+// than one image, any pair whose on-disk manifest big data doesn't
+// actually agree byte-for-byte despite being recorded under the same
+// digest.
+func (r *imageStore) FindDigestManifestConflicts() ([]DigestConflict, error) {
+	var conflicts []DigestConflict
+	for d, images := range r.bydigest {
+		if len(images) < 2 {
+			continue
+		}
+		type manifestBlob struct {
+			imageID string
+			key     string
+			data    []byte
+		}
+		var blobs []manifestBlob
+		for _, image := range images {
+			for _, key := range image.BigDataNames {
+				if !r.isManifest(key) || image.BigDataDigests[key] != d {
+					continue
+				}
+				data, err := ioutil.ReadFile(r.bigDataPath(image, key))
+				if err != nil {
+					continue
+				}
+				blobs = append(blobs, manifestBlob{imageID: image.ID, key: key, data: data})
+				break
+			}
+		}
+		for i := 0; i < len(blobs); i++ {
+			for j := i + 1; j < len(blobs); j++ {
+				if !bytes.Equal(blobs[i].data, blobs[j].data) {
+					conflicts = append(conflicts, DigestConflict{
+						Digest: d,
+						ImageA: blobs[i].imageID,
+						KeyA:   blobs[i].key,
+						ImageB: blobs[j].imageID,
+						KeyB:   blobs[j].key,
+					})
+				}
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// AdoptBigData adopts a file already written to disk at srcPath (for
+// example by a downloader that wrote directly to a temporary location) as a
+// big data item, without ever loading its full contents into memory.  It
+// streams the file into the datadir while computing its digest, verifies
+// that against expectedDigest, and removes srcPath once adopted.  This
+// enables zero-copy ingestion from a separate download stage.
+func (r *imageStore) AdoptBigData(id, key, srcPath string, expectedDigest digest.Digest) error {
+	if key == "" {
+		return errors.Wrapf(ErrInvalidBigDataName, "can't set empty name for image big data item")
+	}
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to save data items associated with images at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if err := os.MkdirAll(r.datadir(image.ID), 0700); err != nil {
+		return err
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	destPath := filepath.Join(r.datadir(image.ID), r.assignBigDataBaseName(image, key))
+	tmpPath := destPath + ".adopting"
+	n, err := func() (int64, error) {
+		lock := r.bigDataLock(image.ID)
+		lock.Lock()
+		defer lock.Unlock()
+		dest, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return 0, err
+		}
+		digester := digest.Canonical.Digester()
+		n, err := io.Copy(io.MultiWriter(dest, digester.Hash()), src)
+		closeErr := dest.Close()
+		if err != nil {
+			os.Remove(tmpPath)
+			return 0, err
+		}
+		if closeErr != nil {
+			os.Remove(tmpPath)
+			return 0, closeErr
+		}
+		if digester.Digest() != expectedDigest {
+			os.Remove(tmpPath)
+			return 0, errors.Errorf("error adopting big data item %q: digest of %q is %q, expected %q", key, srcPath, digester.Digest(), expectedDigest)
+		}
+		if err := os.Rename(tmpPath, destPath); err != nil {
+			os.Remove(tmpPath)
+			return 0, err
+		}
+		return n, nil
+	}()
+	if err != nil {
+		return err
+	}
+	os.Remove(srcPath)
+	if image.BigDataSizes == nil {
+		image.BigDataSizes = make(map[string]int64)
+	}
+	if image.BigDataDigests == nil {
+		image.BigDataDigests = make(map[string]digest.Digest)
+	}
+	image.BigDataSizes[key] = n
+	image.BigDataDigests[key] = expectedDigest
+	addName := true
+	for _, name := range image.BigDataNames {
+		if name == key {
+			addName = false
+			break
+		}
+	}
+	if addName {
+		image.BigDataNames = append(image.BigDataNames, key)
+	}
+	r.bumpGeneration(image.ID)
+	return r.Save()
+}
+
+func (r *imageStore) Wipe() error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete images at %q", r.imagespath())
+	}
+	ids := make([]string, 0, len(r.byid))
+	for id := range r.byid {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if err := r.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneExpired deletes every image whose ExpiresAt is non-zero and in the
+// past, except those pinned via the "pinned" flag or marked ReadOnly, and
+// returns the IDs it removed.
+func (r *imageStore) PruneExpired() ([]string, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete images at %q", r.imagespath())
+	}
+	now := time.Now()
+	var expired []string
+	for _, image := range r.images {
+		if image.ExpiresAt.IsZero() || image.ExpiresAt.After(now) {
+			continue
+		}
+		if image.ReadOnly {
+			continue
+		}
+		if pinned, ok := image.Flags["pinned"].(bool); ok && pinned {
+			continue
+		}
+		expired = append(expired, image.ID)
+	}
+	for _, id := range expired {
+		if err := r.Delete(id); err != nil {
+			return nil, err
+		}
+	}
+	return expired, nil
+}
+
+// ReconcileTo makes the store match desired, reporting every action it
+// takes.  It runs the whole pass under one transaction so that the
+// Create/SetNamesAndMetadata/Delete calls it makes persist together in a
+// single Save on success.  If one of them fails partway through, it
+// doesn't roll the transaction back: whatever already succeeded stays
+// committed, and the returned report, together with the error, tells the
+// caller exactly how far it got.
+func (r *imageStore) ReconcileTo(desired []Image, policy ReconcilePolicy) (ReconcileReport, error) {
+	var report ReconcileReport
+	if !r.IsReadWrite() {
+		return report, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to reconcile images at %q", r.imagespath())
+	}
+	if err := r.Begin(); err != nil {
+		return report, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			r.Rollback()
+		}
+	}()
+
+	fail := func(id string, err error) (ReconcileReport, error) {
+		report.Results = append(report.Results, ReconcileResult{ID: id, Action: ReconcileSkipped, Err: err})
+		if commitErr := r.Commit(); commitErr != nil {
+			return report, commitErr
+		}
+		committed = true
+		return report, err
+	}
+
+	wanted := make(map[string]struct{}, len(desired))
+	for i := range desired {
+		want := &desired[i]
+		wanted[want.ID] = struct{}{}
+		existing, ok := r.lookup(want.ID)
+		if !ok {
+			created, err := r.Create(want.ID, want.Names, want.TopLayer, want.Metadata, want.Created, want.Digest)
+			if err != nil {
+				return fail(want.ID, err)
+			}
+			report.Results = append(report.Results, ReconcileResult{ID: created.ID, Action: ReconcileCreated})
+			existing = created
+		}
+		if !stringSlicesEqual(existing.Names, want.Names) || existing.Metadata != want.Metadata {
+			if err := r.SetNamesAndMetadata(existing.ID, want.Names, want.Metadata); err != nil {
+				return fail(existing.ID, err)
+			}
+			report.Results = append(report.Results, ReconcileResult{ID: existing.ID, Action: ReconcileUpdated})
+		} else {
+			report.Results = append(report.Results, ReconcileResult{ID: existing.ID, Action: ReconcileUnchanged})
+		}
+	}
+
+	if policy.DeleteExtras {
+		for _, image := range append([]*Image{}, r.images...) {
+			if _, isWanted := wanted[image.ID]; isWanted {
+				continue
+			}
+			if pinned, ok := image.Flags["pinned"].(bool); ok && pinned {
+				report.Results = append(report.Results, ReconcileResult{ID: image.ID, Action: ReconcileSkipped})
+				continue
+			}
+			if image.ReadOnly {
+				report.Results = append(report.Results, ReconcileResult{ID: image.ID, Action: ReconcileSkipped})
+				continue
+			}
+			if policy.InUse != nil && policy.InUse(image.ID) {
+				report.Results = append(report.Results, ReconcileResult{ID: image.ID, Action: ReconcileSkipped})
+				continue
+			}
+			if err := r.Delete(image.ID); err != nil {
+				return fail(image.ID, err)
+			}
+			report.Results = append(report.Results, ReconcileResult{ID: image.ID, Action: ReconcileDeleted})
+		}
+	}
+
+	if err := r.Commit(); err != nil {
+		return report, err
+	}
+	committed = true
+	return report, nil
+}
+
+// withLockRetry runs acquire, retrying up to r.lockMaxAttempts times with
+// r.lockBackoff between attempts if it panics (the Locker implementation
+// panics rather than returning an error when acquisition fails), and
+// re-panicking with the last failure once attempts are exhausted.  With the
+// default lockMaxAttempts of 0, it makes exactly one attempt, matching the
+// unconfigured behavior of calling acquire directly.
+func (r *imageStore) withLockRetry(acquire func()) {
+	attempts := r.lockMaxAttempts
+	for attempt := 0; ; attempt++ {
+		failed := func() (panicked bool) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					panicked = true
+					if attempt >= attempts {
+						panic(rec)
+					}
+					logrus.Debugf("retrying lock acquisition on %q after: %v", r.imagespath(), rec)
+				}
+			}()
+			acquire()
+			return false
+		}()
+		if !failed {
+			return
+		}
+		if r.lockBackoff > 0 {
+			time.Sleep(r.lockBackoff)
+		}
+	}
+}
+
+// SetLockRetryPolicy configures Lock and RLock to retry, with backoff
+// between attempts, when acquisition fails transiently instead of failing
+// (or blocking) on the first attempt.  maxAttempts is the number of retries
+// after the initial attempt; zero disables retrying.
+func (r *imageStore) SetLockRetryPolicy(maxAttempts int, backoff time.Duration) {
+	r.lockMaxAttempts = maxAttempts
+	r.lockBackoff = backoff
+}
+
+func (r *imageStore) Lock() {
+	r.withLockRetry(r.lockfile.Lock)
+}
+
+func (r *imageStore) RecursiveLock() {
+	r.withLockRetry(r.lockfile.RecursiveLock)
+}
+
+func (r *imageStore) RLock() {
+	r.withLockRetry(r.lockfile.RLock)
+}
+
+func (r *imageStore) Unlock() {
+	r.lockfile.Unlock()
+}
+
+func (r *imageStore) Touch() error {
+	return r.lockfile.Touch()
+}
+
+func (r *imageStore) Modified() (bool, error) {
+	return r.lockfile.Modified()
+}
+
+func (r *imageStore) IsReadWrite() bool {
+	return r.lockfile.IsReadWrite()
+}
+
+func (r *imageStore) TouchedSince(when time.Time) bool {
+	return r.lockfile.TouchedSince(when)
+}
+
+func (r *imageStore) Locked() bool {
+	return r.lockfile.Locked()
+}
+
+// LastLoadError returns the error, if any, returned by the most recent Load.
+func (r *imageStore) LastLoadError() error {
+	return r.lastLoadErr
+}
+
+// ReloadIfChanged calls Load only if Modified reports that images.json has
+// changed on disk since it was last read, so the common case of polling an
+// unchanged store costs a lockfile stat rather than a full unmarshal and
+// index rebuild.
+func (r *imageStore) ReloadIfChanged() error {
+	r.loadMut.Lock()
+	defer r.loadMut.Unlock()
+
+	modified, err := r.Modified()
+	if err == nil && modified {
+		return r.Load()
+	}
+	if err != nil {
+		r.lastLoadErr = err
+	}
+	return err
+}
@@ -0,0 +1,5 @@
+package chrootarchive
+
+import jsoniter "github.com/json-iterator/go"
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
@@ -0,0 +1,7 @@
+// +build !linux,!freebsd
+
+package mount
+
+func mount(device, target, mType string, flag uintptr, data string) error {
+	panic("Not implemented")
+}
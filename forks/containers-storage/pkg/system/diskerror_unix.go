@@ -0,0 +1,16 @@
+// +build linux freebsd
+
+package system
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsOutOfSpace reports whether err indicates that the underlying
+// filesystem ran out of space, unwrapping through any *os.PathError or
+// similar wrapping to find a syscall.ENOSPC, or false if that can't be
+// determined on this platform.
+func IsOutOfSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
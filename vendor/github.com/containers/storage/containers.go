@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -455,6 +456,42 @@ func (r *containerStore) BigData(id, key string) ([]byte, error) {
 	return ioutil.ReadFile(r.datapath(c.ID, key))
 }
 
+// BigDataRange reads length bytes starting at offset from a big data
+// item, seeking into the file rather than reading it whole, for callers
+// that only need a slice of a large item.
+func (r *containerStore) BigDataRange(id, key string, offset, length int64) ([]byte, error) {
+	if key == "" {
+		return nil, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve container big data value for empty name")
+	}
+	if offset < 0 || length < 0 {
+		return nil, errors.Errorf("invalid range: offset %d, length %d", offset, length)
+	}
+	c, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrContainerUnknown
+	}
+	f, err := os.Open(r.datapath(c.ID, key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if offset+length > info.Size() {
+		return nil, errors.Errorf("requested range [%d, %d) is out of bounds for big data item %q, which is %d bytes", offset, offset+length, key, info.Size())
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 func (r *containerStore) BigDataSize(id, key string) (int64, error) {
 	if key == "" {
 		return -1, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve size of container big data with empty name")
@@ -23,6 +23,8 @@ var (
 	ErrImageUsedByContainer = types.ErrImageUsedByContainer
 	// ErrIncompleteOptions is returned when the caller attempts to initialize a Store without providing required information.
 	ErrIncompleteOptions = types.ErrIncompleteOptions
+	// ErrInsufficientSpace is returned when a store is configured with a minimum free space requirement and there isn't enough available.
+	ErrInsufficientSpace = types.ErrInsufficientSpace
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
 	ErrInvalidBigDataName = types.ErrInvalidBigDataName
 	// ErrLayerHasChildren is returned when the caller attempts to delete a layer that has children.
@@ -55,4 +57,8 @@ var (
 	ErrStoreIsReadOnly = types.ErrStoreIsReadOnly
 	// ErrNotSupported is returned when the requested functionality is not supported.
 	ErrNotSupported = types.ErrNotSupported
+	// ErrStorePermission is returned when a filesystem operation on the store's files fails because of a permissions problem.
+	ErrStorePermission = types.ErrStorePermission
+	// ErrBigDataUnknown is returned when a caller asks for a big data item that isn't present under the given name.
+	ErrBigDataUnknown = types.ErrBigDataUnknown
 )
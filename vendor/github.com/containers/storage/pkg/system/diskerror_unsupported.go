@@ -0,0 +1,10 @@
+// +build !linux,!freebsd
+
+package system
+
+// IsOutOfSpace reports whether err indicates that the underlying
+// filesystem ran out of space, or false if that can't be determined on
+// this platform.
+func IsOutOfSpace(err error) bool {
+	return false
+}
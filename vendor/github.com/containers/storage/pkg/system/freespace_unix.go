@@ -0,0 +1,16 @@
+// +build linux freebsd
+
+package system
+
+import "golang.org/x/sys/unix"
+
+// FreeSpace returns the number of bytes available to an unprivileged user
+// on the filesystem containing path, or ok=false if that can't be
+// determined on this platform.
+func FreeSpace(path string) (free int64, ok bool, err error) {
+	var buf unix.Statfs_t
+	if err := unix.Statfs(path, &buf); err != nil {
+		return 0, true, err
+	}
+	return int64(buf.Bavail) * int64(buf.Bsize), true, nil
+}
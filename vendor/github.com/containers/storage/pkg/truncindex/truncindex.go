@@ -125,6 +125,27 @@ func (idx *TruncIndex) Get(s string) (string, error) {
 	return "", ErrNotExist
 }
 
+// GetAll retrieves every ID in the TruncIndex that starts with the given
+// prefix, unlike Get, which treats more than one match as an error.  An
+// empty prefix matches every ID.
+func (idx *TruncIndex) GetAll(s string) ([]string, error) {
+	if s == "" {
+		return nil, ErrEmptyPrefix
+	}
+	var ids []string
+	subTreeVisitFunc := func(prefix patricia.Prefix, item patricia.Item) error {
+		ids = append(ids, string(prefix))
+		return nil
+	}
+
+	idx.RLock()
+	defer idx.RUnlock()
+	if err := idx.trie.VisitSubtree(patricia.Prefix(s), subTreeVisitFunc); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 // Iterate iterates over all stored IDs and passes each of them to the given
 // handler. Take care that the handler method does not call any public
 // method on truncindex as the internal locking is not reentrant/recursive
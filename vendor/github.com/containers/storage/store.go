@@ -101,6 +101,13 @@ type ROBigDataStore interface {
 	// BigDataNames() returns a list of the names of previously-stored pieces of
 	// data.
 	BigDataNames(id string) ([]string, error)
+
+	// BigDataRange reads length bytes starting at offset from a big
+	// data item, seeking into the file rather than reading it whole,
+	// for callers that only need a header or other slice of a large
+	// item.  It returns an error instead of a short read if the range
+	// doesn't fit within the item's actual size.
+	BigDataRange(id, key string, offset, length int64) ([]byte, error)
 }
 
 // A RWImageBigDataStore wraps up how we store big-data associated with images.
@@ -406,6 +413,16 @@ type Store interface {
 	// ImageSize computes the size of the image's layers and ancillary data.
 	ImageSize(id string) (int64, error)
 
+	// ReclaimableSpace combines RemovableImages's dangling-image
+	// detection with actual layer and big data sizes, returning the
+	// bytes that pruning every unreferenced image would free, along
+	// with their IDs.  A layer shared between a removable image and one
+	// that inUse reports as still in use, or that keeps a name, is
+	// counted once for the whole store, not once per removable image
+	// that references it, and not at all if a surviving image also
+	// references it.
+	ReclaimableSpace(inUse func(id string) bool) (int64, []string, error)
+
 	// ListContainerBigData retrieves a list of the (possibly large) chunks of
 	// named data associated with a container.
 	ListContainerBigData(id string) ([]string, error)
@@ -603,16 +620,17 @@ type store struct {
 // If StoreOptions `options` haven't been fully populated, then DefaultStoreOptions are used.
 //
 // These defaults observe environment variables:
-//  * `STORAGE_DRIVER` for the name of the storage driver to attempt to use
-//  * `STORAGE_OPTS` for the string of options to pass to the driver
+//   - `STORAGE_DRIVER` for the name of the storage driver to attempt to use
+//   - `STORAGE_OPTS` for the string of options to pass to the driver
 //
 // Note that we do some of this work in a child process.  The calling process's
 // main() function needs to import our pkg/reexec package and should begin with
 // something like this in order to allow us to properly start that child
 // process:
-//   if reexec.Init() {
-//       return
-//   }
+//
+//	if reexec.Init() {
+//	    return
+//	}
 func GetStore(options types.StoreOptions) (Store, error) {
 	if options.RunRoot == "" && options.GraphRoot == "" && options.GraphDriverName == "" && len(options.GraphDriverOptions) == 0 {
 		options = types.Options()
@@ -1813,6 +1831,157 @@ func (s *store) ImageSize(id string) (int64, error) {
 	return size, nil
 }
 
+// layerChainIDs returns the ID of topLayer, every layer in
+// mappedTopLayers, and all of their ancestors, by walking each one's
+// Parent chain across every layer store in stores.
+func layerChainIDs(stores []ROLayerStore, topLayer string, mappedTopLayers []string) (map[string]struct{}, error) {
+	queue := make(map[string]struct{})
+	for _, layerID := range append([]string{topLayer}, mappedTopLayers...) {
+		if layerID != "" {
+			queue[layerID] = struct{}{}
+		}
+	}
+	visited := make(map[string]struct{})
+	for len(visited) < len(queue) {
+		for layerID := range queue {
+			if _, ok := visited[layerID]; ok {
+				continue
+			}
+			visited[layerID] = struct{}{}
+			layer, _ := findLayer(stores, layerID)
+			if layer == nil {
+				return nil, errors.Wrapf(ErrLayerUnknown, "error locating layer with ID %q", layerID)
+			}
+			if layer.Parent != "" {
+				queue[layer.Parent] = struct{}{}
+			}
+		}
+	}
+	return visited, nil
+}
+
+// findLayer returns the layer with the given ID and the store that knows
+// about it, searching stores in order, or nil, nil if none of them do.
+func findLayer(stores []ROLayerStore, layerID string) (*Layer, ROLayerStore) {
+	for _, store := range stores {
+		if layer, err := store.Get(layerID); err == nil {
+			return layer, store
+		}
+	}
+	return nil, nil
+}
+
+// ReclaimableSpace computes the bytes that pruning every unreferenced
+// image would free, along with their IDs.  See the Store.ReclaimableSpace
+// documentation for how shared layers are accounted for.
+func (s *store) ReclaimableSpace(inUse func(id string) bool) (int64, []string, error) {
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return -1, nil, errors.Wrapf(err, "error loading primary layer store data")
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return -1, nil, errors.Wrapf(err, "error loading additional layer stores")
+	}
+	allLayerStores := append([]ROLayerStore{lstore}, lstores...)
+	for _, store := range allLayerStores {
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return -1, nil, err
+		}
+	}
+
+	istore, err := s.ImageStore()
+	if err != nil {
+		return -1, nil, errors.Wrapf(err, "error loading primary image store data")
+	}
+	istore.RLock()
+	defer istore.Unlock()
+	if err := istore.ReloadIfChanged(); err != nil {
+		return -1, nil, err
+	}
+
+	removable, err := istore.RemovableImages(inUse)
+	if err != nil {
+		return -1, nil, err
+	}
+	if len(removable) == 0 {
+		return 0, nil, nil
+	}
+	removableIDs := make(map[string]struct{}, len(removable))
+	ids := make([]string, 0, len(removable))
+	for _, image := range removable {
+		removableIDs[image.ID] = struct{}{}
+		ids = append(ids, image.ID)
+	}
+
+	all, err := istore.Images()
+	if err != nil {
+		return -1, nil, err
+	}
+
+	// survivingRefs counts, for every layer, how many images that won't
+	// be pruned still reference it, directly or through a parent chain;
+	// only a layer with no surviving references can be reclaimed.
+	survivingRefs := make(map[string]int)
+	for _, image := range all {
+		if _, removed := removableIDs[image.ID]; removed {
+			continue
+		}
+		chain, err := layerChainIDs(allLayerStores, image.TopLayer, image.MappedTopLayers)
+		if err != nil {
+			return -1, nil, err
+		}
+		for layerID := range chain {
+			survivingRefs[layerID]++
+		}
+	}
+
+	var size int64
+	countedLayers := make(map[string]struct{})
+	for _, image := range removable {
+		chain, err := layerChainIDs(allLayerStores, image.TopLayer, image.MappedTopLayers)
+		if err != nil {
+			return -1, nil, err
+		}
+		for layerID := range chain {
+			if survivingRefs[layerID] > 0 {
+				continue
+			}
+			if _, counted := countedLayers[layerID]; counted {
+				continue
+			}
+			countedLayers[layerID] = struct{}{}
+			layer, layerStore := findLayer(allLayerStores, layerID)
+			if layer == nil {
+				return -1, nil, errors.Wrapf(ErrLayerUnknown, "error locating layer with ID %q", layerID)
+			}
+			n := layer.UncompressedSize
+			if layer.UncompressedDigest == "" {
+				if n, err = layerStore.DiffSize("", layer.ID); err != nil {
+					return -1, nil, errors.Wrapf(err, "size/digest of layer with ID %q could not be calculated", layerID)
+				}
+			}
+			size += n
+		}
+
+		names, err := istore.BigDataNames(image.ID)
+		if err != nil {
+			return -1, nil, errors.Wrapf(err, "error reading list of big data items for image %q", image.ID)
+		}
+		for _, name := range names {
+			n, err := istore.BigDataSize(image.ID, name)
+			if err != nil {
+				return -1, nil, errors.Wrapf(err, "error reading size of big data item %q for image %q", name, image.ID)
+			}
+			size += n
+		}
+	}
+
+	return size, ids, nil
+}
+
 func (s *store) ContainerSize(id string) (int64, error) {
 	lstore, err := s.LayerStore()
 	if err != nil {
@@ -3505,6 +3674,12 @@ func (s *store) Shutdown(force bool) ([]string, error) {
 	if modified {
 		rlstore.Touch()
 	}
+	if istore, ok := s.imageStore.(*imageStore); ok {
+		if flushErr := istore.Flush(); flushErr != nil && err == nil {
+			err = flushErr
+		}
+		istore.stopEventSinks()
+	}
 	return mounted, err
 }
 
@@ -3554,6 +3729,14 @@ func copyStringInt64Map(m map[string]int64) map[string]int64 {
 	return ret
 }
 
+func copyStringStringMap(m map[string]string) map[string]string {
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
 func copyStringDigestMap(m map[string]digest.Digest) map[string]digest.Digest {
 	ret := make(map[string]digest.Digest, len(m))
 	for k, v := range m {
@@ -3571,6 +3754,21 @@ func copyDigestSlice(slice []digest.Digest) []digest.Digest {
 	return ret
 }
 
+func copyInt64Ptr(p *int64) *int64 {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func equalInt64Ptr(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
 // copyStringInterfaceMap still forces us to assume that the interface{} is
 // a non-pointer scalar value
 func copyStringInterfaceMap(m map[string]interface{}) map[string]interface{} {
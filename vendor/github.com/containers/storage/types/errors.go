@@ -23,6 +23,8 @@ var (
 	ErrImageUsedByContainer = errors.New("image is in use by a container")
 	// ErrIncompleteOptions is returned when the caller attempts to initialize a Store without providing required information.
 	ErrIncompleteOptions = errors.New("missing necessary StoreOptions")
+	// ErrInsufficientSpace is returned when a store is configured with a minimum free space requirement and there isn't enough available.
+	ErrInsufficientSpace = errors.New("insufficient free space")
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
 	ErrInvalidBigDataName = errors.New("not a valid name for a big data item")
 	// ErrLayerHasChildren is returned when the caller attempts to delete a layer that has children.
@@ -55,4 +57,8 @@ var (
 	ErrStoreIsReadOnly = errors.New("called a write method on a read-only store")
 	// ErrNotSupported is returned when the requested functionality is not supported.
 	ErrNotSupported = errors.New("not supported")
+	// ErrStorePermission is returned when a filesystem operation on the store's files fails because of a permissions problem.
+	ErrStorePermission = errors.New("insufficient permission to access storage")
+	// ErrBigDataUnknown is returned when a caller asks for a big data item that isn't present under the given name.
+	ErrBigDataUnknown = errors.New("big data item not known")
 )